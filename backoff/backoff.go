@@ -0,0 +1,161 @@
+// Package backoff retries failing operations with exponentially growing
+// delays. The delays are jittered so that many processes failing at the
+// same time, such as the sidecars of a fleet after a metadata outage, do
+// not retry in lockstep.
+package backoff
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of a Backoff, replaced in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Policy describes the delays between retries. The first delay is Initial,
+// each following one twice the previous, up to Max.
+type Policy struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter is the fraction by which each delay is randomly shortened,
+	// from 0 for none to 1
+	Jitter float64
+	// MaxWait gives up once this much time passed since the first
+	// failure, 0 retries forever
+	MaxWait time.Duration
+	// Clock defaults to the system clock
+	Clock Clock
+}
+
+// Validate reports settings that can not be used
+func (p Policy) Validate() error {
+	if p.Initial <= 0 {
+		return fmt.Errorf("Invalid initial delay %v, expected a positive duration", p.Initial)
+	}
+	if p.Max < p.Initial {
+		return fmt.Errorf("Invalid maximum delay %v, expected at least the initial delay %v", p.Max, p.Initial)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Invalid jitter %v, expected a fraction from 0 to 1", p.Jitter)
+	}
+	if p.MaxWait < 0 {
+		return fmt.Errorf("Invalid maximum wait %v, expected 0 or a positive duration", p.MaxWait)
+	}
+	return nil
+}
+
+func (p Policy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
+
+var (
+	// random is shared by all backoffs, seeded so that processes
+	// started together still pick different delays
+	random     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomLock sync.Mutex
+)
+
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	randomLock.Lock()
+	r := random.Float64()
+	randomLock.Unlock()
+	return d - time.Duration(float64(d)*fraction*r)
+}
+
+// Backoff is the state of a series of retries following p
+type Backoff struct {
+	policy Policy
+	// next is the delay before jitter of the next retry, 0 before the
+	// first failure of the series
+	next  time.Duration
+	start time.Time
+}
+
+// New returns a Backoff for a series of retries following p
+func (p Policy) New() *Backoff {
+	b := &Backoff{policy: p}
+	b.Reset()
+	return b
+}
+
+// Reset starts a new series, after the operation succeeded
+func (b *Backoff) Reset() {
+	b.next = 0
+}
+
+// Next returns the delay before the next retry, false once the policy
+// gives up
+func (b *Backoff) Next() (time.Duration, bool) {
+	now := b.policy.clock().Now()
+	if b.next == 0 {
+		b.start = now
+		b.next = b.policy.Initial
+	}
+
+	delay := jitter(b.next, b.policy.Jitter)
+	if b.policy.MaxWait > 0 {
+		left := b.policy.MaxWait - now.Sub(b.start)
+		if left <= 0 {
+			return 0, false
+		}
+		if delay > left {
+			delay = left
+		}
+	}
+
+	b.next *= 2
+	if b.next > b.policy.Max {
+		b.next = b.policy.Max
+	}
+	return delay, true
+}
+
+// Wait waits d on the clock of the policy, false if ctx is done first
+func (b *Backoff) Wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-b.policy.clock().After(d):
+		return true
+	}
+}
+
+// Retry calls op until it succeeds, returning its last error when the
+// policy gives up or ctx is done. failed, if set, is called with every
+// error and the delay before the next try.
+func (p Policy) Retry(ctx context.Context, op func() error, failed func(err error, delay time.Duration)) error {
+	b := p.New()
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		delay, ok := b.Next()
+		if !ok {
+			return fmt.Errorf("Giving up after %v: %v", p.MaxWait, err)
+		}
+		if failed != nil {
+			failed(err, delay)
+		}
+		if !b.Wait(ctx, delay) {
+			return err
+		}
+	}
+}
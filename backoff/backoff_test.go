@@ -0,0 +1,126 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock moves forward by every delay waited for, without sleeping
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.delays = append(f.delays, d)
+	f.now = f.now.Add(d)
+	c := make(chan time.Time, 1)
+	c <- f.now
+	return c
+}
+
+func TestDelaysGrowToMax(t *testing.T) {
+	b := Policy{Initial: time.Second, Max: 10 * time.Second, Clock: &fakeClock{}}.New()
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, seconds := range expected {
+		delay, ok := b.Next()
+		if !ok || delay != seconds*time.Second {
+			t.Fatalf("Retry %d: expected %vs, got %v", i, int(seconds), delay)
+		}
+	}
+
+	b.Reset()
+	if delay, _ := b.Next(); delay != time.Second {
+		t.Fatalf("Expected the initial delay after a reset, got %v", delay)
+	}
+}
+
+func TestJitterShortensDelays(t *testing.T) {
+	b := Policy{Initial: time.Second, Max: time.Second, Jitter: 0.5, Clock: &fakeClock{}}.New()
+	different := false
+	for i := 0; i < 100; i++ {
+		delay, _ := b.Next()
+		if delay < 500*time.Millisecond || delay > time.Second {
+			t.Fatalf("Expected a delay between 0.5s and 1s, got %v", delay)
+		}
+		different = different || delay != time.Second
+	}
+	if !different {
+		t.Fatalf("Expected some delays to be shortened")
+	}
+}
+
+func TestMaxWaitGivesUp(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1451703845, 0)}
+	p := Policy{Initial: time.Second, Max: time.Minute, MaxWait: 10 * time.Second, Clock: clock}
+
+	tries := 0
+	err := p.Retry(context.Background(), func() error {
+		tries++
+		return errors.New("connection refused")
+	}, nil)
+	if err == nil {
+		t.Fatalf("Expected to give up")
+	}
+	// 1+2+4 and the 3 seconds left of the 10
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 3 * time.Second}
+	if tries != 5 || len(clock.delays) != len(expected) {
+		t.Fatalf("Expected 5 tries waiting %v, got %d waiting %v", expected, tries, clock.delays)
+	}
+	for i := range expected {
+		if clock.delays[i] != expected[i] {
+			t.Fatalf("Expected delays %v, got %v", expected, clock.delays)
+		}
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	clock := &fakeClock{}
+	p := Policy{Initial: time.Second, Max: 4 * time.Second, Clock: clock}
+
+	tries := 0
+	failures := 0
+	err := p.Retry(context.Background(), func() error {
+		tries++
+		if tries < 10 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, func(err error, delay time.Duration) { failures++ })
+	if err != nil || tries != 10 || failures != 9 {
+		t.Fatalf("Expected success after 9 failures, got %v after %d tries", err, tries)
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := Policy{Initial: time.Hour, Max: time.Hour}
+	err := p.Retry(ctx, func() error { return errors.New("connection refused") }, nil)
+	if err == nil {
+		t.Fatalf("Expected the error once the context is done")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Policy{Initial: time.Second, Max: time.Minute, Jitter: 0.2}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, p := range []Policy{
+		{Max: time.Minute},
+		{Initial: time.Minute, Max: time.Second},
+		{Initial: time.Second, Max: time.Minute, Jitter: 1.5},
+		{Initial: time.Second, Max: time.Minute, MaxWait: -time.Second},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be invalid", p)
+		}
+	}
+}
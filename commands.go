@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/etc-host-updater/config"
+)
+
+func once(c *cli.Context) error {
+	cfg, err := configs.Load()
+	if err != nil {
+		return err
+	}
+	g, err := newGroup(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	return g.Sync()
+}
+
+func diff(c *cli.Context) error {
+	cfg, err := configs.Load()
+	if err != nil {
+		return err
+	}
+	g, err := newGroup(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	d, err := g.Diff()
+	if err != nil {
+		return err
+	}
+	fmt.Print(d)
+	return nil
+}
+
+func render(c *cli.Context) error {
+	cfg, err := configs.Load()
+	if err != nil {
+		return err
+	}
+	g, err := newGroup(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	data, err := g.Render()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func validateConfig(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		path = configs.path
+	}
+	if path == "" {
+		return fmt.Errorf("No config file given")
+	}
+	if _, err := config.Load(path, configs.flags, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", path)
+	return nil
+}
@@ -0,0 +1,341 @@
+// Package config holds the settings of the updater. They come from the
+// command line flags and an optional YAML or JSON file using the flag names
+// as keys; flags given on the command line take precedence over the file.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/etc-host-updater/backoff"
+	"github.com/rancher/etc-host-updater/hooks"
+	"github.com/rancher/etc-host-updater/selector"
+	"github.com/rancher/etc-host-updater/updater"
+	"gopkg.in/yaml.v2"
+)
+
+// Config mirrors the global flags, the yaml keys are the flag names
+type Config struct {
+	UpdateInterval         int      `yaml:"update-interval"`
+	WaitTimeout            int      `yaml:"wait-timeout"`
+	MetadataURL            string   `yaml:"metadata-url"`
+	MetadataVersion        string   `yaml:"metadata-version"`
+	MetadataTimeout        int      `yaml:"metadata-timeout"`
+	MetadataFixture        string   `yaml:"metadata-fixture"`
+	RetryInitial           int      `yaml:"retry-initial"`
+	RetryMax               int      `yaml:"retry-max"`
+	RetryJitter            float64  `yaml:"retry-jitter"`
+	RetryMaxWait           int      `yaml:"retry-max-wait"`
+	DryRun                 bool     `yaml:"dry-run"`
+	Output                 string   `yaml:"output"`
+	Format                 string   `yaml:"format"`
+	Listen                 string   `yaml:"listen"`
+	StateFile              string   `yaml:"state-file"`
+	StateMaxAge            int      `yaml:"state-max-age"`
+	RestoreOnExit          bool     `yaml:"restore-on-exit"`
+	Sort                   string   `yaml:"sort"`
+	AddressFamily          string   `yaml:"address-family"`
+	AddressLabels          []string `yaml:"address-label"`
+	Hosts                  bool     `yaml:"hosts"`
+	Containers             bool     `yaml:"containers"`
+	Services               bool     `yaml:"services"`
+	HostNameTemplates      []string `yaml:"host-name-template"`
+	ContainerNameTemplates []string `yaml:"container-name-template"`
+	ServiceNameTemplates   []string `yaml:"service-name-template"`
+	Duplicates             string   `yaml:"duplicates"`
+	MaxRemovals            int      `yaml:"max-removals"`
+	MaxRemovalPercent      int      `yaml:"max-removal-percent"`
+	HoldCycles             int      `yaml:"hold-cycles"`
+	HostSelector           string   `yaml:"host-selector"`
+	ContainerSelector      string   `yaml:"container-selector"`
+	ServiceSelector        string   `yaml:"service-selector"`
+	OnChange               []string `yaml:"on-change"`
+	OnChangeTimeout        int      `yaml:"on-change-timeout"`
+	SignalPidFile          string   `yaml:"signal-pid-file"`
+	Signal                 string   `yaml:"signal"`
+	// Targets, if set, replace the output with several, each a map of
+	// settings overriding those above
+	Targets []map[string]interface{} `yaml:"targets"`
+}
+
+// processKeys are the settings of the whole process, which targets can not
+// override
+var processKeys = []string{
+	"update-interval", "wait-timeout", "metadata-url", "metadata-version", "metadata-timeout", "metadata-fixture",
+	"retry-initial", "retry-max", "retry-jitter", "retry-max-wait",
+	"listen", "state-file", "state-max-age", "restore-on-exit", "targets",
+}
+
+// Load builds a validated configuration from defaults, overlaid by the file
+// at path unless path is empty, overlaid by overrides. defaults and
+// overrides map flag names to flag values, names without a setting are
+// ignored.
+func Load(path string, defaults, overrides map[string]interface{}) (*Config, error) {
+	c := &Config{}
+	if err := c.apply(defaults); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config %s: %v", path, err)
+		}
+		// JSON is valid YAML, one parser reads both
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("Error parsing config %s: %v", path, err)
+		}
+	}
+	if err := c.apply(overrides); err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("Invalid config %s: %v", path, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if err := c.validateMetadata(); err != nil {
+		return err
+	}
+	if _, err := c.Retry(); err != nil {
+		return err
+	}
+	if c.StateMaxAge < 0 {
+		return fmt.Errorf("Invalid state-max-age %d, expected 0 or a positive number of seconds", c.StateMaxAge)
+	}
+	targets, err := c.TargetConfigs()
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if _, err := target.Updater(); err != nil {
+			if len(c.Targets) > 0 {
+				return fmt.Errorf("Target %s: %v", target.Output, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// TargetConfigs returns the configuration of every target: c itself when
+// no targets are set, otherwise c overridden by each of the targets
+func (c *Config) TargetConfigs() ([]*Config, error) {
+	if len(c.Targets) == 0 {
+		return []*Config{c}, nil
+	}
+
+	targets := []*Config{}
+	outputs := map[string]bool{}
+	for i, values := range c.Targets {
+		for _, key := range processKeys {
+			if _, ok := values[key]; ok {
+				return nil, fmt.Errorf("Target %d: %s can not be set per target", i+1, key)
+			}
+		}
+
+		target := *c
+		target.Targets = nil
+		data, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &target); err != nil {
+			return nil, fmt.Errorf("Target %d: %v", i+1, err)
+		}
+
+		if outputs[target.Output] {
+			return nil, fmt.Errorf("Target %d: output %s is already used by another target", i+1, target.Output)
+		}
+		outputs[target.Output] = true
+		targets = append(targets, &target)
+	}
+	return targets, nil
+}
+
+// apply sets the settings named in values, going through yaml so the keys
+// are the same as in the file
+func (c *Config) apply(values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, c)
+}
+
+func (c *Config) validateMetadata() error {
+	u, err := url.Parse(c.MetadataURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid metadata-url %q, expected an http or https URL", c.MetadataURL)
+	}
+	if version := strings.Trim(c.MetadataVersion, "/"); version == "" || strings.Contains(version, "/") {
+		return fmt.Errorf("Invalid metadata-version %q, expected an API version such as 2015-12-19", c.MetadataVersion)
+	}
+	if c.MetadataTimeout <= 0 {
+		return fmt.Errorf("Invalid metadata-timeout %d, expected a positive number of seconds", c.MetadataTimeout)
+	}
+	return nil
+}
+
+// State returns the file keeping the last state applied from metadata, nil
+// if none is set
+func (c *Config) State() *updater.StateFile {
+	if c.StateFile == "" {
+		return nil
+	}
+	return &updater.StateFile{
+		Path:   c.StateFile,
+		MaxAge: time.Duration(c.StateMaxAge) * time.Second,
+	}
+}
+
+// Retry returns the policy of retries after failing to reach metadata
+func (c *Config) Retry() (backoff.Policy, error) {
+	p := backoff.Policy{
+		Initial: time.Duration(c.RetryInitial) * time.Second,
+		Max:     time.Duration(c.RetryMax) * time.Second,
+		Jitter:  c.RetryJitter,
+		MaxWait: time.Duration(c.RetryMaxWait) * time.Second,
+	}
+	if err := p.Validate(); err != nil {
+		return backoff.Policy{}, fmt.Errorf("Invalid retry settings: %v", err)
+	}
+	return p, nil
+}
+
+// Updater validates the configuration and returns an Updater with the
+// settings applied. Its MetadataClient and Writer are left to the caller.
+func (c *Config) Updater() (*updater.Updater, error) {
+	if c.UpdateInterval <= 0 {
+		return nil, fmt.Errorf("Invalid update-interval %d, expected a positive number of seconds", c.UpdateInterval)
+	}
+	if c.WaitTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid wait-timeout %d, expected a positive number of seconds", c.WaitTimeout)
+	}
+
+	sortOrder, err := updater.ParseSortOrder(c.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := updater.ParseAddressFamily(c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Output == "" {
+		return nil, fmt.Errorf("No output file given")
+	}
+	renderer, err := updater.ParseFormat(c.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates, err := updater.ParseDuplicatePolicy(c.Duplicates)
+	if err != nil {
+		return nil, err
+	}
+
+	// A removal seen once is applied right away with fewer hold cycles
+	if (c.MaxRemovals > 0 || c.MaxRemovalPercent > 0) && c.HoldCycles < 2 {
+		return nil, fmt.Errorf("Invalid hold-cycles %d, expected at least 2 with max-removals or max-removal-percent set", c.HoldCycles)
+	}
+
+	var templates updater.NameTemplates
+	if templates.Host, err = updater.ParseNameTemplates(updater.SourceHosts, c.HostNameTemplates); err != nil {
+		return nil, err
+	}
+	if templates.Container, err = updater.ParseNameTemplates(updater.SourceContainers, c.ContainerNameTemplates); err != nil {
+		return nil, err
+	}
+	if templates.Service, err = updater.ParseNameTemplates(updater.SourceServices, c.ServiceNameTemplates); err != nil {
+		return nil, err
+	}
+
+	var selectors updater.Selectors
+	if selectors.Host, err = selector.Parse(c.HostSelector); err != nil {
+		return nil, err
+	}
+	if selectors.Container, err = selector.Parse(c.ContainerSelector); err != nil {
+		return nil, err
+	}
+	if selectors.Service, err = selector.Parse(c.ServiceSelector); err != nil {
+		return nil, err
+	}
+
+	changeHooks, err := c.Hooks()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []updater.Source{}
+	if c.Hosts {
+		sources = append(sources, updater.SourceHosts)
+	}
+	if c.Containers {
+		sources = append(sources, updater.SourceContainers)
+	}
+	if c.Services {
+		sources = append(sources, updater.SourceServices)
+	}
+
+	u := &updater.Updater{
+		SortOrder:       sortOrder,
+		Renderer:        renderer,
+		Sources:         sources,
+		NameTemplates:   templates,
+		Selectors:       selectors,
+		DuplicatePolicy: duplicates,
+		AddressFamily:   family,
+		AddressLabels:   c.AddressLabels,
+		Guard: updater.RemovalGuard{
+			MaxRemovals:       c.MaxRemovals,
+			MaxRemovalPercent: c.MaxRemovalPercent,
+			HoldCycles:        c.HoldCycles,
+		},
+	}
+	if len(changeHooks) > 0 {
+		u.OnChange = func(change updater.Change) {
+			hooks.Run(changeHooks, change)
+		}
+	}
+	return u, nil
+}
+
+// Hooks returns the hooks to run after the hosts file changed: the
+// on-change commands in order, then the signal if a pid file is set
+func (c *Config) Hooks() ([]hooks.Hook, error) {
+	if c.OnChangeTimeout <= 0 {
+		return nil, fmt.Errorf("Invalid on-change-timeout %d, expected a positive number of seconds", c.OnChangeTimeout)
+	}
+	sig, err := hooks.ParseSignal(c.Signal)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []hooks.Hook{}
+	for _, command := range c.OnChange {
+		result = append(result, hooks.Command{
+			Command: command,
+			Timeout: time.Duration(c.OnChangeTimeout) * time.Second,
+		})
+	}
+	if c.SignalPidFile != "" {
+		result = append(result, hooks.Signal{
+			PidFile: c.SignalPidFile,
+			Signal:  sig,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+var flags = map[string]interface{}{
+	"config":            "",
+	"output":            "/etc/hosts",
+	"format":            "hosts",
+	"update-interval":   5,
+	"wait-timeout":      60,
+	"metadata-url":      "http://rancher-metadata",
+	"metadata-version":  "2015-12-19",
+	"metadata-timeout":  10,
+	"retry-initial":     1,
+	"retry-max":         60,
+	"retry-jitter":      0.2,
+	"sort":              "hostname",
+	"address-family":    "both",
+	"address-label":     []string{},
+	"hosts":             true,
+	"duplicates":        "first",
+	"hold-cycles":       3,
+	"on-change":         []string{},
+	"on-change-timeout": 30,
+	"signal":            "HUP",
+}
+
+func writeConfig(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadFlagsOnly(t *testing.T) {
+	c, err := Load("", flags, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.UpdateInterval != 5 || !c.Hosts || c.Containers || c.Sort != "hostname" || c.HoldCycles != 3 {
+		t.Fatalf("Expected the flag values, got %+v", c)
+	}
+}
+
+func TestLoadYAMLOverlaysFlags(t *testing.T) {
+	path, cleanup := writeConfig(t, "config.yml", `
+update-interval: 10
+sort: ip
+hosts: false
+containers: true
+address-label: [io.rancher.ips, extra.ips]
+container-selector: role=web
+`)
+	defer cleanup()
+
+	// sort was given on the command line
+	c, err := Load(path, flags, map[string]interface{}{"sort": "host-id"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.UpdateInterval != 10 || c.WaitTimeout != 60 || c.Sort != "host-id" || c.Hosts || !c.Containers {
+		t.Fatalf("Expected file values overridden by the command line, got %+v", c)
+	}
+	if !reflect.DeepEqual(c.AddressLabels, []string{"io.rancher.ips", "extra.ips"}) {
+		t.Fatalf("Expected address labels from the file, got %v", c.AddressLabels)
+	}
+
+	u, err := c.Updater()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(u.Sources, []updater.Source{updater.SourceContainers}) {
+		t.Fatalf("Expected only containers to be published, got %v", u.Sources)
+	}
+	if u.Selectors.Container.String() != "role=web" {
+		t.Fatalf("Expected the container selector from the file, got %s", u.Selectors.Container)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path, cleanup := writeConfig(t, "config.json", `{"services": true, "max-removals": 2, "host-name-template": ["{{.Hostname}}.rancher"]}`)
+	defer cleanup()
+
+	c, err := Load(path, flags, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !c.Services || c.MaxRemovals != 2 || !reflect.DeepEqual(c.HostNameTemplates, []string{"{{.Hostname}}.rancher"}) {
+		t.Fatalf("Expected the JSON values, got %+v", c)
+	}
+}
+
+func TestLoadRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":   "update-intervall: 3\n",
+		"wrong type":    "update-interval: soon\n",
+		"invalid value": "sort: random\n",
+		"bad selector":  "host-selector: 'role in (a'\n",
+		"bad template":  "host-name-template: ['{{.Nope']\n",
+		"zero interval": "update-interval: 0\n",
+		"bad format":    "format: bind\n",
+		"bad signal":    "signal: SIGNOPE\n",
+		"bad retry":     "retry-max: 0\n",
+		"bad max age":   "state-max-age: -1\n",
+		"bad url":       "metadata-url: rancher-metadata\n",
+		"bad version":   "metadata-version: 2015/12/19\n",
+		"no timeout":    "metadata-timeout: 0\n",
+		"no hold":       "max-removals: 2\nhold-cycles: 1\n",
+	}
+	for name, content := range tests {
+		path, cleanup := writeConfig(t, "config.yml", content)
+		_, err := Load(path, flags, nil)
+		cleanup()
+		if err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		if !strings.Contains(err.Error(), path) {
+			t.Fatalf("%s: expected the error to name the file, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load("/nonexistent/config.yml", flags, nil); err == nil {
+		t.Fatalf("Expected an error for a missing file")
+	}
+}
+
+func TestTargetConfigs(t *testing.T) {
+	path, cleanup := writeConfig(t, "config.yml", `
+sort: ip
+address-label: [io.rancher.ips]
+targets:
+- output: /etc/hosts
+- output: /etc/dnsmasq.d/rancher.conf
+  format: dnsmasq
+  address-label: [extra.ips]
+`)
+	defer cleanup()
+
+	c, err := Load(path, flags, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	targets, err := c.TargetConfigs()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected two targets, got %d", len(targets))
+	}
+	if targets[0].Format != "hosts" || targets[0].Sort != "ip" || !reflect.DeepEqual(targets[0].AddressLabels, []string{"io.rancher.ips"}) {
+		t.Fatalf("Expected the first target to inherit the settings, got %+v", targets[0])
+	}
+	if targets[1].Format != "dnsmasq" || targets[1].Sort != "ip" || !reflect.DeepEqual(targets[1].AddressLabels, []string{"extra.ips"}) {
+		t.Fatalf("Expected the second target to override the settings, got %+v", targets[1])
+	}
+	if !reflect.DeepEqual(c.AddressLabels, []string{"io.rancher.ips"}) {
+		t.Fatalf("Expected the top level settings to be kept, got %v", c.AddressLabels)
+	}
+}
+
+func TestTargetConfigsRejected(t *testing.T) {
+	tests := map[string]string{
+		"process key":      "targets:\n- output: /tmp/a\n  update-interval: 3\n",
+		"duplicate output": "targets:\n- output: /tmp/a\n- output: /tmp/a\n  format: dnsmasq\n",
+		"unknown key":      "targets:\n- output: /tmp/a\n  fromat: dnsmasq\n",
+		"invalid value":    "targets:\n- output: /tmp/a\n  format: bind\n",
+	}
+	for name, content := range tests {
+		path, cleanup := writeConfig(t, "config.yml", content)
+		_, err := Load(path, flags, nil)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), "Target ") {
+			t.Fatalf("%s: expected an error naming the target, got %v", name, err)
+		}
+	}
+}
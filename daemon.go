@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/config"
+	"github.com/rancher/etc-host-updater/fixture"
+	"github.com/rancher/etc-host-updater/metadataclient"
+	"github.com/rancher/etc-host-updater/updater"
+	"github.com/rancher/etc-host-updater/watcher"
+)
+
+// daemon keeps the targets of a group up to date with metadata until it
+// is stopped, see run. Updates, repairs and reloads share its state.
+type daemon struct {
+	configs *configLoader
+	// cfg is the config at startup, settings only read at startup are
+	// compared against it on reloads
+	cfg      *config.Config
+	g        *updater.Group
+	state    *updater.StateFile
+	interval time.Duration
+	ctx      context.Context
+
+	// lock keeps reloads from changing the targets during an update
+	lock          sync.Mutex
+	restoreOnExit bool
+	// version is the last metadata version seen, a reload updates for it
+	version      string
+	stopWatching context.CancelFunc
+}
+
+func newDaemon(configs *configLoader, cfg *config.Config, g *updater.Group) *daemon {
+	return &daemon{
+		configs:       configs,
+		cfg:           cfg,
+		g:             g,
+		state:         cfg.State(),
+		interval:      time.Duration(cfg.UpdateInterval) * time.Second,
+		restoreOnExit: cfg.RestoreOnExit,
+	}
+}
+
+// run writes the last known state, waits for metadata and updates the
+// targets for every metadata version until ctx is done or metadata can not
+// be reached. The config is reloaded on hup or when it changes.
+func (d *daemon) run(ctx context.Context, hup <-chan os.Signal) error {
+	ctx, cancel := context.WithCancel(ctx)
+	d.ctx = ctx
+	// From here on the outputs may have been written, by the last known
+	// state if not by an update, and are restored on every way out
+	defer func() {
+		cancel()
+		d.restore()
+	}()
+
+	// The last known state is written while waiting for metadata
+	if d.state != nil {
+		if states, err := d.state.Load(time.Now()); err != nil {
+			log.Errorf("Error loading state, starting without: %v", err)
+		} else if err := d.g.ApplyStates(states); err != nil {
+			log.Errorf("Error applying state [%v]", err)
+		}
+	}
+
+	// Health checks are served while waiting for metadata
+	if err := connect(ctx, d.cfg, d.g); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	d.lock.Lock()
+	d.stopWatching = watchOutputs(ctx, d.g, d.interval, d.repair)
+	d.lock.Unlock()
+	if d.configs.path != "" {
+		go watchConfig(ctx, d.configs.path, hup, d.reload)
+	}
+	return d.versions().Watch(ctx, d.update)
+}
+
+// versions returns the watcher of the metadata versions
+func (d *daemon) versions() versionWatcher {
+	// held back removals are only applied by later cycles, which must
+	// not wait for the next metadata change
+	holding := func() bool {
+		return d.g.Status().Holding()
+	}
+	if f, ok := d.g.MetadataClient.(*fixture.Client); ok {
+		f.Resync = d.interval
+		f.ResyncIf = holding
+		f.OnError = d.g.MetadataError
+		f.OnSuccess = d.g.MetadataReached
+		return f
+	}
+	metadataURL := metadataclient.URL(d.cfg.MetadataURL, d.cfg.MetadataVersion)
+	w := watcher.New(metadataURL, d.interval, time.Duration(d.cfg.WaitTimeout)*time.Second)
+	w.Resync = d.interval
+	w.ResyncIf = holding
+	w.OnError = d.g.MetadataError
+	w.OnSuccess = d.g.MetadataReached
+	w.Retry, _ = d.cfg.Retry()
+	return w
+}
+
+// update updates the targets for version
+func (d *daemon) update(version string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.version = version
+	d.g.Run(version)
+	d.saveState()
+}
+
+// repair writes the outputs changed by other programs again
+func (d *daemon) repair() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.ctx.Err() != nil {
+		// Shutting down, the outputs may have been restored
+		return
+	}
+	if err := d.g.Repair(); err != nil {
+		log.Errorf("Error repairing [%v]", err)
+	}
+}
+
+// restore puts back the original outputs if restore-on-exit is set
+func (d *daemon) restore() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.restoreOnExit {
+		return
+	}
+	if err := d.g.Restore(); err != nil {
+		log.Errorf("Error restoring: %v", err)
+	}
+}
+
+// saveState saves the state of the targets, d.lock must be held
+func (d *daemon) saveState() {
+	if d.state == nil {
+		return
+	}
+	if err := d.state.Save(d.g.States(), time.Now()); err != nil {
+		log.Errorf("Error saving state: %v", err)
+	}
+}
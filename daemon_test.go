@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+const testFixture = "fixture/testdata/fixture.yml"
+
+// testDaemon returns a daemon for the command line args, with the config
+// loaded as main does
+func testDaemon(t *testing.T, args ...string) *daemon {
+	var l *configLoader
+	app := cli.NewApp()
+	app.Flags = appFlags
+	app.Action = func(c *cli.Context) {
+		l = newConfigLoader(c, app.Flags)
+	}
+	if err := app.Run(append([]string{"etc-host-updater"}, args...)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	g, err := buildGroup(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return newDaemon(l, cfg, g)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "etc-host-updater")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return string(data)
+}
+
+func TestRunRestoresWhenMetadataUnreachable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	writeFile(t, hosts, "127.0.0.1    localhost\n")
+	state := &updater.StateFile{Path: filepath.Join(dir, "state.json")}
+	err := state.Save(map[string]updater.State{
+		hosts: {
+			Version: "1",
+			Updated: time.Now(),
+			Hosts:   map[string]string{"host1": "10.1.0.1"},
+			Entries: []updater.Entry{{IP: "10.1.0.1", Names: []string{"host1"}}},
+		},
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	d := testDaemon(t, "--output", hosts, "--state-file", state.Path, "--restore-on-exit",
+		"--metadata-url", "http://127.0.0.1:1", "--retry-initial", "1", "--retry-max", "1", "--retry-max-wait", "1")
+	if err := d.run(context.Background(), nil); err == nil {
+		t.Fatalf("Expected metadata not to be reached")
+	}
+	if entries := d.g.Status().Targets[0].Entries; entries["host1"] != "10.1.0.1" {
+		t.Fatalf("Expected the state to be applied, got %v", entries)
+	}
+	if content := readFile(t, hosts); content != "127.0.0.1    localhost\n" {
+		t.Fatalf("Expected the output to be restored, found %q", content)
+	}
+}
+
+func TestRunRestoresOnCancel(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	writeFile(t, hosts, "127.0.0.1    localhost\n")
+
+	d := testDaemon(t, "--output", hosts, "--metadata-fixture", testFixture, "--restore-on-exit")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.run(ctx, nil)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(readFile(t, hosts), "host2") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the fixture to be written, found %q", readFile(t, hosts))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%v", err)
+	}
+	if content := readFile(t, hosts); content != "127.0.0.1    localhost\n" {
+		t.Fatalf("Expected the output to be restored, found %q", content)
+	}
+}
@@ -0,0 +1,43 @@
+// Package filewatch notices changes of the files written by the updater, so
+// edits by other programs can be repaired without waiting for a metadata
+// change.
+package filewatch
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Watch calls changed when one of paths may have changed, until ctx is
+// done. Changes are noticed with inotify where it is available; changed is
+// called every interval as well, catching what inotify misses, such as
+// files on network filesystems. Calls are never concurrent and a burst of
+// changes during a call results in a single call after it.
+func Watch(ctx context.Context, paths []string, interval time.Duration, changed func()) {
+	events := make(chan struct{}, 1)
+	if err := notify(ctx, paths, events); err != nil {
+		log.Infof("Can not watch %v for changes (%v), checking every %v", paths, err, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+		changed()
+	}
+}
+
+// signal sends to events unless a send is already pending
+func signal(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
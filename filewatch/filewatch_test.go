@@ -0,0 +1,121 @@
+package filewatch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// notifyChanges watches paths with inotify, which is set up on return
+func notifyChanges(t *testing.T, paths []string) (<-chan struct{}, func()) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on linux")
+	}
+	changes := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := notify(ctx, paths, changes); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return changes, cancel
+}
+
+func watch(t *testing.T, paths []string, interval time.Duration) (<-chan struct{}, func()) {
+	changes := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, paths, interval, func() { changes <- struct{}{} })
+	}()
+	return changes, func() {
+		cancel()
+		<-done
+	}
+}
+
+func expectChange(t *testing.T, changes <-chan struct{}, what string) {
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a change after %s", what)
+	}
+}
+
+func TestWatchNoticesChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	changes, stop := notifyChanges(t, []string{path})
+	defer stop()
+
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1 edited\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectChange(t, changes, "writing the file")
+
+	// Replaced by a rename, like the updater itself writes
+	tmp := filepath.Join(dir, ".hosts.new")
+	if err := ioutil.WriteFile(tmp, []byte("10.0.0.2 replaced\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectChange(t, changes, "replacing the file")
+
+	// The replacement is watched too
+	if err := ioutil.WriteFile(path, []byte("10.0.0.3 edited again\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectChange(t, changes, "writing the replaced file")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectChange(t, changes, "removing the file")
+}
+
+func TestWatchIgnoresOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	changes, stop := notifyChanges(t, []string{filepath.Join(dir, "hosts")})
+	defer stop()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	select {
+	case <-changes:
+		t.Fatalf("Expected no change for another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A file created after the watch started is noticed
+	if err := ioutil.WriteFile(filepath.Join(dir, "hosts"), []byte("10.0.0.1 new\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectChange(t, changes, "creating the file")
+}
+
+func TestWatchPollsWithoutInotify(t *testing.T) {
+	changes, stop := watch(t, []string{"/nonexistent/dir/hosts"}, 10*time.Millisecond)
+	defer stop()
+
+	expectChange(t, changes, "the interval")
+	expectChange(t, changes, "another interval")
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package filewatch
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// fileEvents are the changes of the content of a watched file. A
+	// file replaced by a rename is watched again after the event.
+	fileEvents = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	// dirEvents are the changes of the directory entry of a watched file
+	dirEvents = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+		syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+)
+
+// inotify watches files and their directories. The files are watched for
+// changes made through another path, such as the other side of a bind
+// mount; the directories for files being created, replaced or removed.
+type inotify struct {
+	fd    int
+	paths []string
+	// dirs maps the watch descriptor of every directory to the names of
+	// the watched files in it
+	dirs map[int][]string
+	// files are the watch descriptors of the files
+	files map[int]bool
+}
+
+// notify sends to events when inotify reports a change of one of paths,
+// until ctx is done
+func notify(ctx context.Context, paths []string, events chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &inotify{
+		fd:    fd,
+		paths: paths,
+		dirs:  map[int][]string{},
+		files: map[int]bool{},
+	}
+	for _, path := range paths {
+		dir, name := filepath.Split(filepath.Clean(path))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, dirEvents)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		w.dirs[wd] = append(w.dirs[wd], name)
+	}
+	w.watchFiles()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.read(ctx, events)
+	}()
+	go func() {
+		<-ctx.Done()
+		// Removing a watch queues an event, which ends the read
+		// blocked in the other goroutine. The descriptor is only
+		// closed after, so its number can not be reused meanwhile.
+		for wd := range w.dirs {
+			syscall.InotifyRmWatch(fd, uint32(wd))
+		}
+		<-done
+		syscall.Close(fd)
+	}()
+	return nil
+}
+
+// watchFiles watches the files themselves. Files that do not exist yet are
+// watched once their directory reports them.
+func (w *inotify) watchFiles() {
+	for _, path := range w.paths {
+		wd, err := syscall.InotifyAddWatch(w.fd, path, fileEvents)
+		if err != nil {
+			log.Debugf("Not watching %s itself: %v", path, err)
+			continue
+		}
+		w.files[wd] = true
+	}
+}
+
+func (w *inotify) read(ctx context.Context, events chan<- struct{}) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Errorf("Error reading inotify events: %v", err)
+			return
+		}
+		if w.relevant(buf[:n]) {
+			w.watchFiles()
+			signal(events)
+		}
+	}
+}
+
+// relevant reports whether any of the events concerns a watched file
+func (w *inotify) relevant(buf []byte) bool {
+	found := false
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		if nameEnd > len(buf) {
+			break
+		}
+		name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+		offset = nameEnd
+
+		if w.files[int(event.Wd)] {
+			found = true
+			continue
+		}
+		for _, watched := range w.dirs[int(event.Wd)] {
+			if name == watched {
+				found = true
+			}
+		}
+	}
+	return found
+}
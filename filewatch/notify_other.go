@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package filewatch
+
+import (
+	"context"
+	"errors"
+)
+
+func notify(ctx context.Context, paths []string, events chan<- struct{}) error {
+	return errors.New("inotify is only available on linux")
+}
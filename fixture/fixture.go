@@ -0,0 +1,223 @@
+// Package fixture serves metadata from a file instead of rancher-metadata,
+// for tests, air-gapped labs and reproducing bugs. The file has the shape
+// of the JSON the metadata API answers for its root, so a dump of
+//
+//	curl -H 'Accept: application/json' http://rancher-metadata/2015-12-19
+//
+// can be used as is. It may be written in YAML with the same keys:
+//
+//	version: "1"
+//	self:
+//	  host: {hostname: host1, agent_ip: 10.1.0.1}
+//	hosts:
+//	- {hostname: host1, agent_ip: 10.1.0.1, uuid: 6e3d6a3c}
+//	containers: []
+//	services: []
+//
+// Keys other than these are ignored. Without a version the version is a
+// hash of the content.
+package fixture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/filewatch"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"gopkg.in/yaml.v2"
+)
+
+// pollInterval is how often the file is checked for changes inotify missed
+const pollInterval = 5 * time.Second
+
+type content struct {
+	Version string `json:"version"`
+	Self    struct {
+		Container *metadata.Container `json:"container"`
+		Host      *metadata.Host      `json:"host"`
+	} `json:"self"`
+	Hosts      []metadata.Host      `json:"hosts"`
+	Containers []metadata.Container `json:"containers"`
+	Services   []metadata.Service   `json:"services"`
+}
+
+// Client is a MetadataClient answering from a fixture file
+type Client struct {
+	// Resync calls do of Watch again with the current version when the
+	// file did not change for this long, 0 disables it
+	Resync time.Duration
+	// ResyncIf, if set, limits resyncs to when it returns true
+	ResyncIf func() bool
+	// OnError, if set, is called with every error reading the file
+	OnError func(error)
+	// OnSuccess, if set, is called after every successful read of the
+	// file, changed or not
+	OnSuccess func()
+
+	path    string
+	lock    sync.RWMutex
+	content content
+}
+
+// Load returns a client answering from the file at path
+func Load(path string) (*Client, error) {
+	c := &Client{path: path}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) String() string {
+	return c.path
+}
+
+// reload reads the file again and reports whether its version changed. A
+// file that can not be read leaves the previous content.
+func (c *Client) reload() (bool, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return false, fmt.Errorf("Error reading metadata fixture %s: %v", c.path, err)
+	}
+	next, err := parse(data)
+	if err != nil {
+		return false, fmt.Errorf("Error parsing metadata fixture %s: %v", c.path, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := next.Version != c.content.Version
+	c.content = next
+	return changed, nil
+}
+
+// parse reads JSON or YAML. YAML is converted to JSON first, so the keys
+// are those of the json tags of the metadata types either way.
+func parse(data []byte) (content, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return content{}, err
+	}
+	data, err := json.Marshal(jsonValue(value))
+	if err != nil {
+		return content{}, err
+	}
+	c := content{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return content{}, err
+	}
+	if c.Version == "" {
+		sum := sha256.Sum256(data)
+		c.Version = hex.EncodeToString(sum[:6])
+	}
+	return c, nil
+}
+
+// jsonValue replaces the maps with interface{} keys yaml produces by maps
+// json can encode
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+	}
+	return value
+}
+
+// Version returns the version of the content
+func (c *Client) Version() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.content.Version
+}
+
+// Watch calls do with the version of the file and with every version after
+// it, until ctx is done. The file is watched with filewatch. Errors reading
+// it are reported to OnError and keep the previous content.
+func (c *Client) Watch(ctx context.Context, do func(string)) error {
+	version := c.Version()
+	last := time.Now()
+	do(version)
+
+	filewatch.Watch(ctx, []string{c.path}, pollInterval, func() {
+		changed, err := c.reload()
+		if err != nil {
+			log.Errorf("%v", err)
+			if c.OnError != nil {
+				c.OnError(err)
+			}
+			return
+		}
+		if c.OnSuccess != nil {
+			c.OnSuccess()
+		}
+		if !changed && !c.resync(last) {
+			return
+		}
+		if changed {
+			log.Infof("Metadata fixture %s changed to version %s", c.path, c.Version())
+		}
+		last = time.Now()
+		do(c.Version())
+	})
+	return nil
+}
+
+// resync reports whether do has to be called again with an unchanged
+// version last called at last
+func (c *Client) resync(last time.Time) bool {
+	if c.Resync <= 0 || time.Since(last) < c.Resync {
+		return false
+	}
+	return c.ResyncIf == nil || c.ResyncIf()
+}
+
+func (c *Client) GetSelfContainer() (metadata.Container, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.content.Self.Container == nil {
+		return metadata.Container{}, fmt.Errorf("No self container in %s", c.path)
+	}
+	return *c.content.Self.Container, nil
+}
+
+func (c *Client) GetSelfHost() (metadata.Host, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.content.Self.Host == nil {
+		return metadata.Host{}, fmt.Errorf("No self host in %s", c.path)
+	}
+	return *c.content.Self.Host, nil
+}
+
+func (c *Client) GetHosts() ([]metadata.Host, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.content.Hosts, nil
+}
+
+func (c *Client) GetContainers() ([]metadata.Container, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.content.Containers, nil
+}
+
+func (c *Client) GetServices() ([]metadata.Service, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.content.Services, nil
+}
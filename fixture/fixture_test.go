@@ -0,0 +1,158 @@
+package fixture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+func TestLoadYAML(t *testing.T) {
+	c, err := Load("testdata/fixture.yml")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.Version() != "12" {
+		t.Fatalf("Expected version 12, got %q", c.Version())
+	}
+	hosts, _ := c.GetHosts()
+	if len(hosts) != 2 || hosts[0].AgentIP != "10.1.0.1" || hosts[0].Labels["io.rancher.host.region"] != "eu" {
+		t.Fatalf("Expected the hosts of the fixture, got %+v", hosts)
+	}
+	containers, _ := c.GetContainers()
+	services, _ := c.GetServices()
+	if len(containers) != 1 || containers[0].PrimaryIp != "10.42.0.5" || len(services) != 1 || services[0].Vip != "169.254.64.10" {
+		t.Fatalf("Expected the containers and services of the fixture, got %+v %+v", containers, services)
+	}
+	if host, err := c.GetSelfHost(); err != nil || host.Hostname != "host1" {
+		t.Fatalf("Expected the self host, got %+v %v", host, err)
+	}
+	if _, err := c.GetSelfContainer(); err == nil {
+		t.Fatalf("Expected an error without a self container")
+	}
+}
+
+func TestLoadMetadataDump(t *testing.T) {
+	c, err := Load("testdata/metadata.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.Version() != "45-6f1e" {
+		t.Fatalf("Expected version 45-6f1e, got %q", c.Version())
+	}
+	container, err := c.GetSelfContainer()
+	if err != nil || container.PrimaryIp != "10.42.0.7" {
+		t.Fatalf("Expected the self container, got %+v %v", container, err)
+	}
+	if hosts, _ := c.GetHosts(); len(hosts) != 1 || hosts[0].HostId != 3 {
+		t.Fatalf("Expected the host of the dump, got %+v", hosts)
+	}
+}
+
+func TestVersionFromContent(t *testing.T) {
+	path, cleanup := writeFixture(t, "hosts: [{hostname: host1, agent_ip: 10.1.0.1}]\n")
+	defer cleanup()
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	version := c.Version()
+	if version == "" {
+		t.Fatalf("Expected a version without one in the file")
+	}
+	if err := ioutil.WriteFile(path, []byte("hosts: [{hostname: host1, agent_ip: 10.1.0.2}]\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if changed, err := c.reload(); err != nil || !changed || c.Version() == version {
+		t.Fatalf("Expected a new version for new content, got %q %v", c.Version(), err)
+	}
+}
+
+func TestInvalidFixture(t *testing.T) {
+	if _, err := Load("testdata/missing.yml"); err == nil {
+		t.Fatalf("Expected an error for a missing file")
+	}
+
+	path, cleanup := writeFixture(t, "version: \"1\"\nhosts: [{hostname: host1, agent_ip: 10.1.0.1}]\n")
+	defer cleanup()
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, invalid := range []string{"hosts: [unclosed\n", "hosts: {hostname: host1}\n"} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := c.reload(); err == nil || !strings.Contains(err.Error(), path) {
+			t.Fatalf("Expected an error naming the file for %q, got %v", invalid, err)
+		}
+	}
+	if hosts, _ := c.GetHosts(); len(hosts) != 1 || c.Version() != "1" {
+		t.Fatalf("Expected the previous content to be kept, got %+v", hosts)
+	}
+}
+
+func TestWatchUpdatesHostsFile(t *testing.T) {
+	path, cleanup := writeFixture(t, "version: \"1\"\nhosts: [{hostname: host1, agent_ip: 10.1.0.1}]\n")
+	defer cleanup()
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	output := filepath.Join(filepath.Dir(path), "hosts")
+	u := &updater.Updater{
+		MetadataClient: c,
+		Writer:         updater.FileWriter{Path: output},
+	}
+	versions := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, func(version string) {
+		u.Run(version)
+		versions <- version
+	})
+
+	expectVersion(t, versions, "1")
+	if err := ioutil.WriteFile(path, []byte("version: \"2\"\nhosts: [{hostname: host1, agent_ip: 10.1.0.9}]\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectVersion(t, versions, "2")
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(string(data), "10.1.0.9    host1\n") {
+		t.Fatalf("Expected the changed address in the hosts file, found\n%s", data)
+	}
+}
+
+func expectVersion(t *testing.T, versions <-chan string, expected string) {
+	select {
+	case version := <-versions:
+		if version != expected {
+			t.Fatalf("Expected version %s, got %s", expected, version)
+		}
+	case <-time.After(2 * pollInterval):
+		t.Fatalf("Expected version %s", expected)
+	}
+}
+
+func writeFixture(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	path := filepath.Join(dir, "fixture.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
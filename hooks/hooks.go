@@ -0,0 +1,135 @@
+// Package hooks tells other programs that the hosts file changed, by
+// running commands or signalling a process.
+package hooks
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+// Hook is told about a change of the hosts file
+type Hook interface {
+	fmt.Stringer
+	Run(change updater.Change) error
+}
+
+// Run runs hooks in order, logging their failures
+func Run(hooks []Hook, change updater.Change) {
+	for _, hook := range hooks {
+		log.Debugf("Running hook %s", hook)
+		if err := hook.Run(change); err != nil {
+			log.Errorf("Error running hook %s: %v", hook, err)
+		}
+	}
+}
+
+// Command runs a shell command. The environment describes the change:
+// HOSTS_ADDED, HOSTS_CHANGED and HOSTS_REMOVED hold space separated names.
+type Command struct {
+	Command string
+	// Timeout kills the command when it runs longer, 0 disables it
+	Timeout time.Duration
+}
+
+func (c Command) String() string {
+	return fmt.Sprintf("%q", c.Command)
+}
+
+func (c Command) Run(change updater.Change) error {
+	cmd := exec.Command("/bin/sh", "-c", c.Command)
+	cmd.Env = append(os.Environ(),
+		"HOSTS_ADDED="+strings.Join(change.Added, " "),
+		"HOSTS_CHANGED="+strings.Join(change.Changed, " "),
+		"HOSTS_REMOVED="+strings.Join(change.Removed, " "),
+	)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Its own process group lets a timeout kill the children of the
+	// shell too, which would otherwise keep the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var killed int32
+	if c.Timeout > 0 {
+		timer := time.AfterFunc(c.Timeout, func() {
+			atomic.StoreInt32(&killed, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+
+	err := cmd.Wait()
+	if atomic.LoadInt32(&killed) == 1 {
+		return fmt.Errorf("Timed out after %v, output: %q", c.Timeout, output.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%v, output: %q", err, output.String())
+	}
+	if output.Len() > 0 {
+		log.Infof("Hook %s: %s", c, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// Signal sends a signal to the process whose pid is in PidFile. The file
+// is read every time, so a restarted process is found.
+type Signal struct {
+	PidFile string
+	Signal  syscall.Signal
+}
+
+func (s Signal) String() string {
+	return fmt.Sprintf("signal %v to %s", s.Signal, s.PidFile)
+}
+
+func (s Signal) Run(updater.Change) error {
+	data, err := ioutil.ReadFile(s.PidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("Invalid pid in %s: %q", s.PidFile, strings.TrimSpace(string(data)))
+	}
+	return syscall.Kill(pid, s.Signal)
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// ParseSignal accepts a signal name with or without the SIG prefix, such
+// as HUP or SIGUSR1, or a signal number
+func ParseSignal(s string) (syscall.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("Invalid signal %q", s)
+}
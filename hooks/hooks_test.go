@@ -0,0 +1,109 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+func TestCommandGetsChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	c := Command{
+		Command: `echo "$HOSTS_ADDED|$HOSTS_CHANGED|$HOSTS_REMOVED" > ` + out,
+		Timeout: 5 * time.Second,
+	}
+	err = c.Run(updater.Change{
+		Added:   []string{"host1", "host2"},
+		Removed: []string{"host3"},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(data) != "host1 host2||host3\n" {
+		t.Fatalf("Expected the change in the environment, found %q", string(data))
+	}
+}
+
+func TestCommandFailure(t *testing.T) {
+	err := Command{Command: "echo broken; exit 3", Timeout: 5 * time.Second}.Run(updater.Change{})
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected the exit status and output, got %v", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := Command{Command: "sleep 10", Timeout: 100 * time.Millisecond}.Run(updater.Change{})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the command to be killed")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGUSR1)
+	defer signal.Stop(received)
+
+	if err := (Signal{PidFile: pidFile, Signal: syscall.SIGUSR1}).Run(updater.Change{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected SIGUSR1 to be received")
+	}
+
+	if err := (Signal{PidFile: filepath.Join(dir, "missing"), Signal: syscall.SIGUSR1}).Run(updater.Change{}); err == nil {
+		t.Fatalf("Expected an error for a missing pid file")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for s, expected := range map[string]syscall.Signal{
+		"HUP":     syscall.SIGHUP,
+		"sigusr2": syscall.SIGUSR2,
+		"SIGTERM": syscall.SIGTERM,
+		"10":      syscall.Signal(10),
+	} {
+		if sig, err := ParseSignal(s); err != nil || sig != expected {
+			t.Fatalf("Expected %s to parse as %v, got %v %v", s, expected, sig, err)
+		}
+	}
+	for _, s := range []string{"", "NOPE", "-1"} {
+		if _, err := ParseSignal(s); err == nil {
+			t.Fatalf("Expected %q to be rejected", s)
+		}
+	}
+}
@@ -1,22 +1,210 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/rancher/etc-host-updater/config"
+	"github.com/rancher/etc-host-updater/filewatch"
+	"github.com/rancher/etc-host-updater/fixture"
+	"github.com/rancher/etc-host-updater/metadataclient"
+	"github.com/rancher/etc-host-updater/server"
 	"github.com/rancher/etc-host-updater/updater"
-	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 const (
-	metadataURL = "http://rancher-metadata/2015-12-19"
+	hostsFile = "/etc/hosts"
 )
 
 var (
 	VERSION = "dev"
 )
 
+// appFlags are the global flags, each may also be set in the --config file
+var appFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "config",
+		Usage: "YAML or JSON file setting any of the other flags by name, reloaded on SIGHUP or when it changes",
+	},
+	cli.IntFlag{
+		Name:  "update-interval",
+		Value: 5,
+		Usage: "time interval between refreshes of host list when metadata does not support waiting for changes (in seconds)",
+	},
+	cli.IntFlag{
+		Name:  "wait-timeout",
+		Value: 60,
+		Usage: "maximum time a request for metadata changes blocks (in seconds)",
+	},
+	cli.StringFlag{
+		Name:  "metadata-url",
+		Value: "http://rancher-metadata",
+		Usage: "base URL of the metadata service",
+	},
+	cli.StringFlag{
+		Name:  "metadata-version",
+		Value: "2015-12-19",
+		Usage: "metadata API version to read",
+	},
+	cli.IntFlag{
+		Name:  "metadata-timeout",
+		Value: 10,
+		Usage: "maximum time a metadata request other than waiting for changes takes (in seconds)",
+	},
+	cli.StringFlag{
+		Name:  "metadata-fixture",
+		Usage: "read metadata from this JSON or YAML file in the shape of the metadata API instead of rancher-metadata, watching it for changes",
+	},
+	cli.IntFlag{
+		Name:  "retry-initial",
+		Value: 1,
+		Usage: "delay before retrying to reach metadata after the first failure, doubled after each further one (in seconds)",
+	},
+	cli.IntFlag{
+		Name:  "retry-max",
+		Value: 60,
+		Usage: "maximum delay between retries to reach metadata (in seconds)",
+	},
+	cli.Float64Flag{
+		Name:  "retry-jitter",
+		Value: 0.2,
+		Usage: "fraction by which retry delays are randomly shortened, so many updaters do not retry at once",
+	},
+	cli.IntFlag{
+		Name:  "retry-max-wait",
+		Usage: "exit when metadata could not be reached for this long, 0 retries forever, or 20 seconds for once, diff and render (in seconds)",
+	},
+	cli.StringFlag{
+		Name:  "output",
+		Value: hostsFile,
+		Usage: "file to write the entries to",
+	},
+	cli.StringFlag{
+		Name:  "format",
+		Value: "hosts",
+		Usage: "format of the output: hosts, coredns (hosts plugin), dnsmasq (host-record), dnsmasq-address or unbound (local-data)",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "log the changes that would be made to /etc/hosts instead of writing them",
+	},
+	cli.StringFlag{
+		Name:  "listen",
+		Usage: "address to serve /healthz, /readyz, /state and /metrics on, e.g. ':8080'",
+	},
+	cli.StringFlag{
+		Name:  "state-file",
+		Usage: "file keeping the entries last applied from metadata, applied at startup until metadata answers",
+	},
+	cli.IntFlag{
+		Name:  "state-max-age",
+		Value: 86400,
+		Usage: "age after which the entries in --state-file are too stale to be applied, 0 for any age (in seconds)",
+	},
+	cli.BoolFlag{
+		Name:  "restore-on-exit",
+		Usage: "put back the original /etc/hosts content when stopped",
+	},
+	cli.StringFlag{
+		Name:  "sort",
+		Value: string(updater.SortByHostname),
+		Usage: "order of the generated entries: hostname, ip or host-id",
+	},
+	cli.StringFlag{
+		Name:  "address-family",
+		Value: string(updater.FamilyBoth),
+		Usage: "addresses to publish: v4, v6 or both",
+	},
+	cli.StringSliceFlag{
+		Name:  "address-label",
+		Value: &cli.StringSlice{},
+		Usage: "label listing extra comma separated addresses of a host, container or service, may be repeated",
+	},
+	cli.BoolTFlag{
+		Name:  "hosts",
+		Usage: "publish rancher hosts as <hostname>",
+	},
+	cli.BoolFlag{
+		Name:  "containers",
+		Usage: "publish containers as <container>",
+	},
+	cli.BoolFlag{
+		Name:  "services",
+		Usage: "publish service VIPs as <service>.<stack>",
+	},
+	cli.StringSliceFlag{
+		Name:  "host-name-template",
+		Value: &cli.StringSlice{},
+		Usage: "Go template over metadata.Host rendering the names of a host, may be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "container-name-template",
+		Value: &cli.StringSlice{},
+		Usage: "Go template over metadata.Container rendering the names of a container, may be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "service-name-template",
+		Value: &cli.StringSlice{},
+		Usage: "Go template over metadata.Service rendering the names of a service, may be repeated",
+	},
+	cli.StringFlag{
+		Name:  "duplicates",
+		Value: string(updater.DuplicateFirst),
+		Usage: "what to publish for a name of several objects: first, lowest-id, newest, all or suffix",
+	},
+	cli.IntFlag{
+		Name:  "max-removals",
+		Usage: "hold back updates removing more than this many entries at once, 0 disables",
+	},
+	cli.IntFlag{
+		Name:  "max-removal-percent",
+		Usage: "hold back updates removing more than this percentage of the entries at once, 0 disables",
+	},
+	cli.IntFlag{
+		Name:  "hold-cycles",
+		Value: 3,
+		Usage: "number of update cycles in a row a held back removal must be seen before it is applied, at least 2",
+	},
+	cli.StringSliceFlag{
+		Name:  "on-change",
+		Value: &cli.StringSlice{},
+		Usage: "shell command run after /etc/hosts changed, with the changed names in HOSTS_ADDED, HOSTS_CHANGED and HOSTS_REMOVED, may be repeated",
+	},
+	cli.IntFlag{
+		Name:  "on-change-timeout",
+		Value: 30,
+		Usage: "time an on-change command may run before it is killed (in seconds)",
+	},
+	cli.StringFlag{
+		Name:  "signal-pid-file",
+		Usage: "file with the pid of a process to signal after /etc/hosts changed",
+	},
+	cli.StringFlag{
+		Name:  "signal",
+		Value: "HUP",
+		Usage: "signal sent to the process in --signal-pid-file",
+	},
+	cli.StringFlag{
+		Name:  "host-selector",
+		Usage: "label selector limiting the published hosts, e.g. 'role=db,!hosts.exclude'",
+	},
+	cli.StringFlag{
+		Name:  "container-selector",
+		Usage: "label selector limiting the published containers",
+	},
+	cli.StringFlag{
+		Name:  "service-selector",
+		Usage: "label selector limiting the published services",
+	},
+}
+
 func main() {
 	exit := func(err error) {
 		if err != nil {
@@ -32,32 +220,216 @@ func main() {
 
 	Populates /etc/hosts of a rancher managed container based on currently registered
 	hosts in a given rancher environment`
-	app.Flags = []cli.Flag{
-		cli.IntFlag{
-			Name:  "update-interval",
-			Value: 5,
-			Usage: "time interval between refreshes of host list (in seconds)",
-		},
+	app.Flags = appFlags
+	app.Before = func(c *cli.Context) error {
+		configs = newConfigLoader(c, app.Flags)
+		return nil
 	}
 	app.Action = func(c *cli.Context) {
 		exit(run(c))
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "once",
+			Usage: "update /etc/hosts once and exit, failing if the update fails",
+			Action: func(c *cli.Context) {
+				exit(once(c))
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "print a unified diff of the changes an update would make to /etc/hosts",
+			Action: func(c *cli.Context) {
+				exit(diff(c))
+			},
+		},
+		{
+			Name:  "render",
+			Usage: "print the /etc/hosts content an update would write",
+			Action: func(c *cli.Context) {
+				exit(render(c))
+			},
+		},
+		{
+			Name:  "validate-config",
+			Usage: "check the config file given as argument or by --config and exit",
+			Action: func(c *cli.Context) {
+				exit(validateConfig(c))
+			},
+		},
+	}
 
 	exit(app.Run(os.Args))
 }
 
 func run(c *cli.Context) error {
-	metadataClient, err := metadata.NewClientAndWait(metadataURL)
+	cfg, err := configs.Load()
+	if err != nil {
+		return err
+	}
+	g, err := buildGroup(cfg)
 	if err != nil {
 		return err
 	}
 
-	interval := c.Int("update-interval")
-	u := &updater.Updater{
-		MetadataClient: metadataClient,
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
+	// Subscribed before waiting for metadata, which would otherwise be
+	// cut short by a SIGHUP; it is handled once reloads start
+	var hup chan os.Signal
+	if configs.path != "" {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	if cfg.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return fmt.Errorf("Error listening on %s: %v", cfg.Listen, err)
+		}
+		go func() {
+			if err := server.Serve(ctx, l, g); err != nil {
+				log.Errorf("Error serving status: %v", err)
+			}
+		}()
+	}
+
+	return newDaemon(configs, cfg, g).run(ctx, hup)
+}
+
+// versionWatcher calls do for every metadata version, see watcher.Watcher
+// and fixture.Client
+type versionWatcher interface {
+	Watch(ctx context.Context, do func(string)) error
+}
+
+// restartNeeded reports whether next changes settings that are only read
+// at startup
+func restartNeeded(cfg, next *config.Config) bool {
+	return next.UpdateInterval != cfg.UpdateInterval ||
+		next.WaitTimeout != cfg.WaitTimeout ||
+		next.MetadataURL != cfg.MetadataURL ||
+		next.MetadataVersion != cfg.MetadataVersion ||
+		next.MetadataTimeout != cfg.MetadataTimeout ||
+		next.MetadataFixture != cfg.MetadataFixture ||
+		next.Listen != cfg.Listen ||
+		next.StateFile != cfg.StateFile ||
+		next.StateMaxAge != cfg.StateMaxAge ||
+		next.RetryInitial != cfg.RetryInitial ||
+		next.RetryMax != cfg.RetryMax ||
+		next.RetryJitter != cfg.RetryJitter ||
+		next.RetryMaxWait != cfg.RetryMaxWait
+}
+
+// watchOutputs repairs the outputs of g when other programs change them,
+// until the returned function is called
+func watchOutputs(ctx context.Context, g *updater.Group, interval time.Duration, repair func()) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go filewatch.Watch(ctx, outputs(g), interval, repair)
+	return cancel
+}
+
+// outputs returns the output of every target of g
+func outputs(g *updater.Group) []string {
+	paths := []string{}
+	for _, u := range g.Targets {
+		paths = append(paths, u.Writer.String())
+	}
+	return paths
+}
+
+// oneShotMaxWait is the retry-max-wait of the one-shot commands when none
+// is set, they fail rather than wait for metadata forever
+const oneShotMaxWait = 20
+
+// newGroup builds the targets of cfg, validating them before connecting to
+// metadata, for the one-shot commands
+func newGroup(ctx context.Context, cfg *config.Config) (*updater.Group, error) {
+	g, err := buildGroup(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RetryMaxWait == 0 {
+		bounded := *cfg
+		bounded.RetryMaxWait = oneShotMaxWait
+		cfg = &bounded
+	}
+	if err := connect(ctx, cfg, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// connect waits for metadata to answer, retrying as cfg says, and sets the
+// metadata client of g. A metadata fixture is read right away.
+func connect(ctx context.Context, cfg *config.Config, g *updater.Group) error {
+	if cfg.MetadataFixture != "" {
+		f, err := fixture.Load(cfg.MetadataFixture)
+		if err != nil {
+			return err
+		}
+		log.Infof("Reading metadata from %s", f)
+		g.MetadataClient = f
+		return nil
 	}
 
-	metadataClient.OnChange(interval, u.Run)
-	// It never exits
+	retry, err := cfg.Retry()
+	if err != nil {
+		return err
+	}
+	metadataClient := metadataclient.New(cfg.MetadataURL, cfg.MetadataVersion, time.Duration(cfg.MetadataTimeout)*time.Second)
+	err = retry.Retry(ctx, func() error {
+		_, err := metadataClient.GetVersion()
+		return err
+	}, func(err error, delay time.Duration) {
+		log.Warnf("Error reaching metadata at %s, retrying in %v: %v", metadataClient, delay, err)
+		g.MetadataError(err)
+	})
+	if err != nil {
+		return fmt.Errorf("Error reaching metadata at %s: %v", metadataClient, err)
+	}
+	g.MetadataClient = metadataClient
 	return nil
 }
+
+// buildGroup returns a Group updating the targets of cfg, without a
+// metadata client
+func buildGroup(cfg *config.Config) (*updater.Group, error) {
+	targets, err := cfg.TargetConfigs()
+	if err != nil {
+		return nil, err
+	}
+	updaters := []*updater.Updater{}
+	for _, target := range targets {
+		u, err := buildUpdater(target)
+		if err != nil {
+			return nil, err
+		}
+		updaters = append(updaters, u)
+	}
+	return updater.NewGroup(nil, updaters...), nil
+}
+
+// buildUpdater returns an Updater with the settings and writer of cfg and
+// without a metadata client
+func buildUpdater(cfg *config.Config) (*updater.Updater, error) {
+	u, err := cfg.Updater()
+	if err != nil {
+		return nil, err
+	}
+
+	var writer updater.Writer = updater.FileWriter{Path: cfg.Output}
+	if cfg.DryRun {
+		writer = updater.DryRun(writer)
+	}
+	u.Writer = writer
+	return u, nil
+}
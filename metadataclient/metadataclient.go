@@ -0,0 +1,129 @@
+// Package metadataclient reads rancher-metadata over HTTP. Unlike the
+// client of go-rancher-metadata every request has a timeout, so a hung
+// connection can not stall the updater, and the API version is chosen by
+// the caller.
+package metadataclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// maxErrorBody is how much of the body of a failed request is read, so the
+// connection can be reused
+const maxErrorBody = 4096
+
+// Client reads metadata of one API version
+type Client struct {
+	url    string
+	client *http.Client
+}
+
+// New returns a client for the API version of the metadata service at
+// baseURL, such as http://rancher-metadata and 2015-12-19. A request
+// taking longer than timeout fails.
+func New(baseURL, version string, timeout time.Duration) *Client {
+	return &Client{
+		url: URL(baseURL, version),
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// URL joins the base URL of the metadata service and an API version
+func URL(baseURL, version string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.Trim(version, "/")
+}
+
+func (c *Client) String() string {
+	return c.url
+}
+
+// ParseVersion reads the answer of /version, a JSON string or, from some
+// metadata services, the bare version
+func ParseVersion(body []byte) string {
+	return strings.Trim(string(body), "\"\n")
+}
+
+// get reads path and decodes the JSON answer into v
+func (c *Client) get(path string, v interface{}) error {
+	body, err := c.read(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("Error parsing %v path: %v", path, err)
+	}
+	return nil
+}
+
+// read returns the body of the answer to path
+func (c *Client) read(path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+		return nil, fmt.Errorf("Error %v accessing %v path", resp.StatusCode, path)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %v path: %v", path, err)
+	}
+	return body, nil
+}
+
+func (c *Client) GetVersion() (string, error) {
+	body, err := c.read("/version")
+	if err != nil {
+		return "", err
+	}
+	return ParseVersion(body), nil
+}
+
+func (c *Client) GetSelfContainer() (metadata.Container, error) {
+	var container metadata.Container
+	err := c.get("/self/container", &container)
+	return container, err
+}
+
+func (c *Client) GetSelfHost() (metadata.Host, error) {
+	var host metadata.Host
+	err := c.get("/self/host", &host)
+	return host, err
+}
+
+func (c *Client) GetHosts() ([]metadata.Host, error) {
+	var hosts []metadata.Host
+	err := c.get("/hosts", &hosts)
+	return hosts, err
+}
+
+func (c *Client) GetContainers() ([]metadata.Container, error) {
+	var containers []metadata.Container
+	err := c.get("/containers", &containers)
+	return containers, err
+}
+
+func (c *Client) GetServices() ([]metadata.Service, error) {
+	var services []metadata.Service
+	err := c.get("/services", &services)
+	return services, err
+}
@@ -0,0 +1,107 @@
+package metadataclient
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetUsesVersion(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Accept") != "application/json" {
+			t.Errorf("Expected a JSON request, got Accept %q", r.Header.Get("Accept"))
+		}
+		switch r.URL.Path {
+		case "/2016-07-29/version":
+			w.Write([]byte(`"42"`))
+		case "/2016-07-29/hosts":
+			w.Write([]byte(`[{"hostname": "host1", "agent_ip": "10.1.0.1", "host_id": 1}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL+"/", "/2016-07-29", time.Second)
+	if c.String() != server.URL+"/2016-07-29" {
+		t.Fatalf("Expected the version in the URL, got %s", c)
+	}
+	if version, err := c.GetVersion(); err != nil || version != "42" {
+		t.Fatalf("Expected version 42, got %q %v", version, err)
+	}
+	hosts, err := c.GetHosts()
+	if err != nil || len(hosts) != 1 || hosts[0].AgentIP != "10.1.0.1" || hosts[0].HostId != 1 {
+		t.Fatalf("Expected host1, got %+v %v", hosts, err)
+	}
+	if _, err := c.GetServices(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected the status in the error, got %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("Expected 3 requests, got %v", paths)
+	}
+}
+
+func TestGetVersionBare(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("42\n"))
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "2015-12-19", time.Second)
+	if version, err := c.GetVersion(); err != nil || version != "42" {
+		t.Fatalf("Expected version 42, got %q %v", version, err)
+	}
+}
+
+func TestGetTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := New(server.URL, "2015-12-19", 50*time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := c.GetHosts()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected the hung request to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the hung request to time out")
+	}
+}
+
+func TestGetReusesConnectionAfterError(t *testing.T) {
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	c := New(server.URL, "2015-12-19", time.Second)
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetHosts(); err == nil {
+			t.Fatalf("Expected an error for status 503")
+		}
+	}
+	if connections != 1 {
+		t.Fatalf("Expected the failed responses to be closed and the connection reused, got %d connections", connections)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/rancher/etc-host-updater/config"
+)
+
+// configPollInterval is how often the config file is checked for changes,
+// shortened in tests
+var configPollInterval = 5 * time.Second
+
+// configs loads the configuration, it is set up before any action runs
+var configs *configLoader
+
+// configLoader loads the configuration from the global flags and the
+// --config file
+type configLoader struct {
+	path string
+	// flags maps every flag to its value, set maps the flags given on the
+	// command line, which take precedence over the file
+	flags map[string]interface{}
+	set   map[string]interface{}
+}
+
+// newConfigLoader reads the flags of the app context c. Command contexts
+// can not tell which global flags were given, so this has to run before
+// the command.
+func newConfigLoader(c *cli.Context, flags []cli.Flag) *configLoader {
+	l := &configLoader{
+		path:  c.String("config"),
+		flags: map[string]interface{}{},
+		set:   map[string]interface{}{},
+	}
+	for _, flag := range flags {
+		var (
+			name  string
+			value interface{}
+		)
+		switch f := flag.(type) {
+		case cli.IntFlag:
+			name, value = f.Name, c.Int(f.Name)
+		case cli.Float64Flag:
+			name, value = f.Name, c.Float64(f.Name)
+		case cli.BoolFlag:
+			name, value = f.Name, c.Bool(f.Name)
+		case cli.BoolTFlag:
+			name, value = f.Name, c.BoolT(f.Name)
+		case cli.StringFlag:
+			name, value = f.Name, c.String(f.Name)
+		case cli.StringSliceFlag:
+			name, value = f.Name, c.StringSlice(f.Name)
+		default:
+			continue
+		}
+		l.flags[name] = value
+		if c.IsSet(name) {
+			l.set[name] = value
+		}
+	}
+	return l
+}
+
+func (l *configLoader) Load() (*config.Config, error) {
+	return config.Load(l.path, l.flags, l.set)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stat(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// watchConfig calls reload when a signal is received on hup or the file at
+// path changes, until ctx is done
+func watchConfig(ctx context.Context, path string, hup <-chan os.Signal, reload func()) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	last := stat(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-hup:
+			log.Infof("Received %v, reloading %s", sig, path)
+		case <-ticker.C:
+			if stamp := stat(path); stamp == last {
+				continue
+			}
+			log.Infof("%s changed, reloading", path)
+		}
+		last = stat(path)
+		reload()
+	}
+}
+
+// reload applies the config file again, keeping the previous config if the
+// file is invalid
+func (d *daemon) reload() {
+	next, err := d.configs.Load()
+	if err != nil {
+		log.Errorf("Error reloading config, keeping the previous one: %v", err)
+		return
+	}
+	nextGroup, err := buildGroup(next)
+	if err != nil {
+		log.Errorf("Error reloading config, keeping the previous one: %v", err)
+		return
+	}
+	if restartNeeded(d.cfg, next) {
+		log.Warn("Changes of update-interval, wait-timeout, listen, the metadata, retry and state settings take effect after a restart")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.ctx.Err() != nil {
+		// Shutting down, the outputs may have been restored
+		return
+	}
+	log.Infof("Reloaded config %s", d.configs.path)
+	before := outputs(d.g)
+	d.g.Reconfigure(nextGroup)
+	if !reflect.DeepEqual(outputs(d.g), before) {
+		d.stopWatching()
+		d.stopWatching = watchOutputs(d.ctx, d.g, d.interval, d.repair)
+	}
+	d.restoreOnExit = next.RestoreOnExit
+	d.g.Run(d.version)
+	d.saveState()
+}
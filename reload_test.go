@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/fixture"
+)
+
+func TestReloadKeepsConfigWhenInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "hosts")
+	second := filepath.Join(dir, "hosts2")
+	path := filepath.Join(dir, "config.yml")
+	writeFile(t, path, "output: "+first+"\n")
+
+	d := testDaemon(t, "--config", path, "--metadata-fixture", testFixture)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.ctx = ctx
+	d.stopWatching = func() {}
+	f, err := fixture.Load(testFixture)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	d.g.MetadataClient = f
+
+	writeFile(t, path, "output: "+second+"\nsort: random\n")
+	d.reload()
+	if outputs := outputs(d.g); !reflect.DeepEqual(outputs, []string{first}) {
+		t.Fatalf("Expected the previous config to be kept, got outputs %v", outputs)
+	}
+
+	writeFile(t, path, "output: "+second+"\nrestore-on-exit: true\n")
+	d.reload()
+	if outputs := outputs(d.g); !reflect.DeepEqual(outputs, []string{second}) {
+		t.Fatalf("Expected the new output, got %v", outputs)
+	}
+	if !d.restoreOnExit {
+		t.Fatalf("Expected restore-on-exit to be reloaded")
+	}
+	if content := readFile(t, second); !strings.Contains(content, "host2") {
+		t.Fatalf("Expected the new output to be written, found %q", content)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	writeFile(t, path, "update-interval: 5\n")
+
+	defer func(orig time.Duration) { configPollInterval = orig }(configPollInterval)
+	configPollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	reloads := make(chan struct{}, 10)
+	go watchConfig(ctx, path, hup, func() {
+		reloads <- struct{}{}
+	})
+
+	expectReload := func(cause string) {
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a reload after %s", cause)
+		}
+	}
+	hup <- syscall.SIGHUP
+	expectReload("SIGHUP")
+
+	writeFile(t, path, "update-interval: 10\n")
+	expectReload("a change of the file")
+
+	select {
+	case <-reloads:
+		t.Fatalf("Expected no reload without a change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
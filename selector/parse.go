@@ -0,0 +1,170 @@
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdentifier
+	tokenEquals
+	tokenDoubleEquals
+	tokenNotEquals
+	tokenBang
+	tokenComma
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+func isIdentifierChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-_./", c) >= 0
+}
+
+func lex(expr string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ","})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case strings.HasPrefix(expr[i:], "=="):
+			tokens = append(tokens, token{tokenDoubleEquals, "=="})
+			i += 2
+		case c == '=':
+			tokens = append(tokens, token{tokenEquals, "="})
+			i++
+		case strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, token{tokenNotEquals, "!="})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, token{tokenBang, "!"})
+			i++
+		case isIdentifierChar(c):
+			start := i
+			for i < len(expr) && isIdentifierChar(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdentifier, expr[start:i]})
+		default:
+			return nil, fmt.Errorf("Invalid selector %q: unexpected character %q at offset %d", expr, c, i)
+		}
+	}
+	return append(tokens, token{kind: tokenEnd}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) requirement() (Requirement, error) {
+	if p.peek().kind == tokenBang {
+		p.next()
+		key, err := p.identifier("label key")
+		if err != nil {
+			return Requirement{}, err
+		}
+		return Requirement{Key: key, Operator: DoesNotExist}, nil
+	}
+
+	key, err := p.identifier("label key")
+	if err != nil {
+		return Requirement{}, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenEquals || t.kind == tokenDoubleEquals || t.kind == tokenNotEquals:
+		p.next()
+		op := Equals
+		if t.kind == tokenNotEquals {
+			op = NotEquals
+		}
+		// An empty value is allowed: "key=" matches a label set to ""
+		value := ""
+		if p.peek().kind == tokenIdentifier {
+			value = p.next().value
+		}
+		return Requirement{Key: key, Operator: op, Values: []string{value}}, nil
+	case t.kind == tokenIdentifier && (t.value == string(In) || t.value == string(NotIn)):
+		p.next()
+		values, err := p.values()
+		if err != nil {
+			return Requirement{}, err
+		}
+		return Requirement{Key: key, Operator: Operator(t.value), Values: values}, nil
+	case t.kind == tokenComma || t.kind == tokenEnd:
+		return Requirement{Key: key, Operator: Exists}, nil
+	}
+	return Requirement{}, fmt.Errorf("expected an operator after %q but found %s", key, t)
+}
+
+func (p *parser) values() ([]string, error) {
+	if t := p.next(); t.kind != tokenOpen {
+		return nil, fmt.Errorf("expected '(' but found %s", t)
+	}
+	values := []string{}
+	for {
+		value, err := p.identifier("value")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		switch t := p.next(); t.kind {
+		case tokenClose:
+			return values, nil
+		case tokenComma:
+		default:
+			return nil, fmt.Errorf("expected ',' or ')' but found %s", t)
+		}
+	}
+}
+
+func (p *parser) identifier(what string) (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier {
+		return "", fmt.Errorf("expected %s but found %s", what, t)
+	}
+	return t.value, nil
+}
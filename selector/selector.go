@@ -0,0 +1,129 @@
+// Package selector implements label selectors in the style of Kubernetes,
+// used to decide which metadata objects are published.
+//
+// A selector is a comma separated list of requirements that must all match:
+//
+//	role=db               label equals value (== is accepted too)
+//	role!=db              label is missing or has another value
+//	zone in (east,west)   label is one of the values
+//	zone notin (east)     label is missing or not one of the values
+//	hosts.exclude         label exists
+//	!hosts.exclude        label does not exist
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operator is the comparison of a single requirement
+type Operator string
+
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is one condition on a label
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Matches reports whether labels satisfy the requirement
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case Equals:
+		return ok && value == r.Values[0]
+	case NotEquals:
+		return !ok || value != r.Values[0]
+	case In:
+		return ok && contains(r.Values, value)
+	case NotIn:
+		return !ok || !contains(r.Values, value)
+	case Exists:
+		return ok
+	case DoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case Equals, NotEquals:
+		return r.Key + string(r.Operator) + r.Values[0]
+	case In, NotIn:
+		return r.Key + " " + string(r.Operator) + " (" + strings.Join(r.Values, ",") + ")"
+	case DoesNotExist:
+		return "!" + r.Key
+	}
+	return r.Key
+}
+
+// Selector is a list of requirements that must all match. The empty
+// selector matches everything.
+type Selector []Requirement
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parse parses a selector expression. An empty or blank expression yields
+// the empty selector.
+func Parse(expr string) (Selector, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	selector := Selector{}
+	if p.peek().kind == tokenEnd {
+		return selector, nil
+	}
+	for {
+		r, err := p.requirement()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid selector %q: %v", expr, err)
+		}
+		selector = append(selector, r)
+
+		switch t := p.next(); t.kind {
+		case tokenEnd:
+			return selector, nil
+		case tokenComma:
+		default:
+			return nil, fmt.Errorf("Invalid selector %q: expected ',' but found %s", expr, t)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
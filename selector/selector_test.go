@@ -0,0 +1,130 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected Selector
+	}{
+		{"", Selector{}},
+		{"   ", Selector{}},
+		{"role=db", Selector{{"role", Equals, []string{"db"}}}},
+		{"role==db", Selector{{"role", Equals, []string{"db"}}}},
+		{"role = db", Selector{{"role", Equals, []string{"db"}}}},
+		{"role=", Selector{{"role", Equals, []string{""}}}},
+		{"role!=db", Selector{{"role", NotEquals, []string{"db"}}}},
+		{"zone in (east, west)", Selector{{"zone", In, []string{"east", "west"}}}},
+		{"zone notin (east)", Selector{{"zone", NotIn, []string{"east"}}}},
+		{"io.rancher/host.os", Selector{{"io.rancher/host.os", Exists, nil}}},
+		{"!hosts.exclude", Selector{{"hosts.exclude", DoesNotExist, nil}}},
+		{
+			"role=db,zone in (east,west), !hosts.exclude,tier",
+			Selector{
+				{"role", Equals, []string{"db"}},
+				{"zone", In, []string{"east", "west"}},
+				{"hosts.exclude", DoesNotExist, nil},
+				{"tier", Exists, nil},
+			},
+		},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Parsing %q: %v", c.expr, err)
+		}
+		if !reflect.DeepEqual(s, c.expected) {
+			t.Fatalf("Parsing %q: expected %#v, found %#v", c.expr, c.expected, s)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		",",
+		"role=db,",
+		"=db",
+		"role=db=x",
+		"role db",
+		"zone in east",
+		"zone in ()",
+		"zone in (east",
+		"zone in (east west)",
+		"zone notin",
+		"!",
+		"!role=db",
+		"role>1",
+		"role=d b",
+		"role=\"db\"",
+	}
+	for _, expr := range invalid {
+		if s, err := Parse(expr); err == nil {
+			t.Fatalf("Expected %q to be rejected, parsed as %#v", expr, s)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]string{
+		"role":  "db",
+		"zone":  "east",
+		"empty": "",
+	}
+	cases := []struct {
+		expr    string
+		matches bool
+	}{
+		{"", true},
+		{"role=db", true},
+		{"role=web", false},
+		{"missing=db", false},
+		{"role!=web", true},
+		{"role!=db", false},
+		{"missing!=db", true},
+		{"zone in (east,west)", true},
+		{"zone in (west)", false},
+		{"missing in (east)", false},
+		{"zone notin (west)", true},
+		{"zone notin (east,west)", false},
+		{"missing notin (east)", true},
+		{"role", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!role", false},
+		{"empty=", true},
+		{"empty", true},
+		{"role=db,zone=east", true},
+		{"role=db,zone=west", false},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Parsing %q: %v", c.expr, err)
+		}
+		if s.Matches(labels) != c.matches {
+			t.Fatalf("Expected %q matching %v to be %v", c.expr, labels, c.matches)
+		}
+	}
+
+	s, err := Parse("!hosts.exclude")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !s.Matches(nil) {
+		t.Fatalf("Expected !hosts.exclude to match an object without labels")
+	}
+}
+
+func TestString(t *testing.T) {
+	expr := "role=db,zone in (east,west),!hosts.exclude,tier,x!=y"
+	s, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.String() != expr {
+		t.Fatalf("Expected %q, found %q", expr, s.String())
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+const metricPrefix = "etc_host_updater_"
+
+type metric struct {
+	name, kind, help string
+	// value returns the value of a target, false if it has none
+	value func(m updater.Metrics, now time.Time) (float64, bool)
+}
+
+func counter(name, help string, value func(m updater.Metrics) uint64) metric {
+	return metric{name, "counter", help, func(m updater.Metrics, now time.Time) (float64, bool) {
+		return float64(value(m)), true
+	}}
+}
+
+var metrics = []metric{
+	counter("update_cycles_total", "Update cycles run.", func(m updater.Metrics) uint64 { return m.Cycles }),
+	counter("writes_total", "Writes of the hosts file attempted.", func(m updater.Metrics) uint64 { return m.Writes }),
+	counter("write_failures_total", "Writes of the hosts file that failed.", func(m updater.Metrics) uint64 { return m.WriteFailures }),
+	counter("metadata_errors_total", "Errors reading rancher-metadata.", func(m updater.Metrics) uint64 { return m.MetadataErrors }),
+	counter("hosts_added_total", "Names added to the hosts file.", func(m updater.Metrics) uint64 { return m.HostsAdded }),
+	counter("hosts_changed_total", "Names whose addresses changed in the hosts file.", func(m updater.Metrics) uint64 { return m.HostsChanged }),
+	counter("hosts_removed_total", "Names removed from the hosts file.", func(m updater.Metrics) uint64 { return m.HostsRemoved }),
+	counter("repairs_total", "Changes of the managed block by other programs that were repaired.", func(m updater.Metrics) uint64 { return m.Repairs }),
+	counter("held_updates_total", "Updates held back by the removal guard.", func(m updater.Metrics) uint64 { return m.Holds }),
+	{"managed_entries", "gauge", "Names currently published in the hosts file.", func(m updater.Metrics, now time.Time) (float64, bool) {
+		return float64(m.Entries), true
+	}},
+	{"last_success_timestamp_seconds", "gauge", "Unix time of the last successful update, 0 before the first.", func(m updater.Metrics, now time.Time) (float64, bool) {
+		return unixSeconds(m.LastSuccess), true
+	}},
+	{"metadata_version_age_seconds", "gauge", "Seconds since the metadata version last changed.", func(m updater.Metrics, now time.Time) (float64, bool) {
+		return now.Sub(m.VersionChanged).Seconds(), !m.VersionChanged.IsZero()
+	}},
+}
+
+// writeMetrics writes the metrics of every target in the Prometheus text
+// exposition format, labelled with the target. Ages are relative to now.
+func writeMetrics(w io.Writer, targets []updater.Metrics, now time.Time) error {
+	buf := &bytes.Buffer{}
+	for _, metric := range metrics {
+		name := metricPrefix + metric.name
+		samples := &bytes.Buffer{}
+		for _, m := range targets {
+			if value, ok := metric.value(m, now); ok {
+				fmt.Fprintf(samples, "%s{target=\"%s\"} %s\n", name, escapeLabel(m.Target), strconv.FormatFloat(value, 'f', -1, 64))
+			}
+		}
+		if samples.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, metric.help, name, metric.kind)
+		buf.Write(samples.Bytes())
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// escapeLabel escapes a label value as the text format requires
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	now := time.Unix(1451703845, 0)
+	m := updater.Metrics{
+		Target:         "/etc/hosts",
+		Cycles:         7,
+		Writes:         3,
+		WriteFailures:  1,
+		MetadataErrors: 2,
+		HostsAdded:     4,
+		HostsRemoved:   1,
+		Repairs:        2,
+		Holds:          5,
+		Entries:        3,
+		LastSuccess:    now.Add(-90 * time.Second),
+		VersionChanged: now.Add(-1500 * time.Millisecond),
+	}
+
+	buf := &bytes.Buffer{}
+	other := updater.Metrics{Target: `/chroot/"a"/hosts`, Cycles: 1}
+	if err := writeMetrics(buf, []updater.Metrics{m, other}, now); err != nil {
+		t.Fatalf("%v", err)
+	}
+	output := buf.String()
+	for _, line := range []string{
+		"# TYPE etc_host_updater_update_cycles_total counter\n" +
+			"etc_host_updater_update_cycles_total{target=\"/etc/hosts\"} 7\n" +
+			"etc_host_updater_update_cycles_total{target=\"/chroot/\\\"a\\\"/hosts\"} 1\n",
+		"etc_host_updater_writes_total{target=\"/etc/hosts\"} 3\n",
+		"etc_host_updater_write_failures_total{target=\"/etc/hosts\"} 1\n",
+		"etc_host_updater_metadata_errors_total{target=\"/etc/hosts\"} 2\n",
+		"etc_host_updater_hosts_added_total{target=\"/etc/hosts\"} 4\n",
+		"etc_host_updater_hosts_changed_total{target=\"/etc/hosts\"} 0\n",
+		"etc_host_updater_hosts_removed_total{target=\"/etc/hosts\"} 1\n",
+		"etc_host_updater_repairs_total{target=\"/etc/hosts\"} 2\n",
+		"etc_host_updater_held_updates_total{target=\"/etc/hosts\"} 5\n",
+		"# TYPE etc_host_updater_managed_entries gauge\netc_host_updater_managed_entries{target=\"/etc/hosts\"} 3\n",
+		"etc_host_updater_last_success_timestamp_seconds{target=\"/etc/hosts\"} 1451703755\n",
+		"etc_host_updater_metadata_version_age_seconds{target=\"/etc/hosts\"} 1.5\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Fatalf("Expected %q in the metrics, got\n%s", line, output)
+		}
+	}
+}
+
+func TestWriteMetricsBeforeFirstUpdate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeMetrics(buf, []updater.Metrics{{Target: "/etc/hosts"}}, time.Now()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(buf.String(), "etc_host_updater_last_success_timestamp_seconds{target=\"/etc/hosts\"} 0\n") {
+		t.Fatalf("Expected no last success, got\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "metadata_version_age_seconds") {
+		t.Fatalf("Expected no version age without a version, got\n%s", buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	code, body := get(t, Handler(&fakeSource{metrics: []updater.Metrics{{Target: "/etc/hosts", Cycles: 1}}}), "/metrics")
+	if code != http.StatusOK || !strings.Contains(body, "etc_host_updater_update_cycles_total{target=\"/etc/hosts\"} 1\n") {
+		t.Fatalf("Expected the metrics, got %d %q", code, body)
+	}
+}
@@ -0,0 +1,93 @@
+// Package server serves the status of the updater over HTTP:
+//
+//	/healthz  200 while metadata is reachable and the last write of every
+//	          target succeeded
+//	/readyz   200 once every target had a successful update
+//	/state    the current status as JSON
+//	/metrics  the metrics in the Prometheus text format
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+// StatusSource is implemented by updater.Group
+type StatusSource interface {
+	Status() updater.GroupStatus
+	Metrics() []updater.Metrics
+}
+
+// Handler returns the handler of the status endpoints of source
+func Handler(source StatusSource) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		failures := []string{}
+		for _, status := range source.Status().Targets {
+			problems := []string{}
+			if !status.MetadataReachable {
+				problems = append(problems, "metadata unreachable")
+			}
+			if !status.WriteSucceeded {
+				problems = append(problems, "last write failed")
+			}
+			if len(problems) > 0 {
+				failures = append(failures, fmt.Sprintf("%s: %s: %s", status.Target, strings.Join(problems, ", "), status.LastError))
+			}
+		}
+		if len(failures) > 0 {
+			fail(w, "%s", strings.Join(failures, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !source.Status().Ready() {
+			fail(w, "no successful update yet")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(source.Status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, source.Metrics(), time.Now())
+	})
+	return mux
+}
+
+func fail(w http.ResponseWriter, format string, args ...interface{}) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+// Serve serves the status of source on l until ctx is done
+func Serve(ctx context.Context, l net.Listener, source StatusSource) error {
+	srv := &http.Server{Handler: Handler(source)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Serving status on %s", l.Addr())
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/updater"
+)
+
+// fakeSource has a single target unless more are added to others
+type fakeSource struct {
+	status  updater.Status
+	others  []updater.Status
+	metrics []updater.Metrics
+}
+
+func (f *fakeSource) Status() updater.GroupStatus {
+	return updater.GroupStatus{Targets: append([]updater.Status{f.status}, f.others...)}
+}
+
+func (f *fakeSource) Metrics() []updater.Metrics {
+	return f.metrics
+}
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return rec.Code, string(body)
+}
+
+func TestHealthz(t *testing.T) {
+	source := &fakeSource{status: updater.Status{MetadataReachable: true, WriteSucceeded: true}}
+	h := Handler(source)
+
+	if code, _ := get(t, h, "/healthz"); code != http.StatusOK {
+		t.Fatalf("Expected healthy, got %d", code)
+	}
+
+	source.status.MetadataReachable = false
+	source.status.LastError = "connection refused"
+	code, body := get(t, h, "/healthz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "metadata unreachable: connection refused") {
+		t.Fatalf("Expected unhealthy for unreachable metadata, got %d %q", code, body)
+	}
+
+	source.status.MetadataReachable = true
+	source.others = []updater.Status{{Target: "/chroot/etc/hosts", MetadataReachable: true}}
+	code, body = get(t, h, "/healthz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "/chroot/etc/hosts: last write failed") {
+		t.Fatalf("Expected unhealthy for a failed write of one target, got %d %q", code, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	source := &fakeSource{}
+	h := Handler(source)
+
+	if code, _ := get(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready, got %d", code)
+	}
+	source.status.Ready = true
+	if code, _ := get(t, h, "/readyz"); code != http.StatusOK {
+		t.Fatalf("Expected ready, got %d", code)
+	}
+	source.others = []updater.Status{{Target: "/chroot/etc/hosts"}}
+	if code, _ := get(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready while a target is not, got %d", code)
+	}
+}
+
+func TestState(t *testing.T) {
+	source := &fakeSource{status: updater.Status{
+		Target:     "/etc/hosts",
+		Entries:    map[string]string{"host1": "10.1.0.1"},
+		Duplicates: []updater.Duplicate{{Name: "host2", Claims: []string{"10.1.0.2", "10.1.0.3"}}},
+		Version:    "42",
+		LastUpdate: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+	}}
+	code, body := get(t, Handler(source), "/state")
+	if code != http.StatusOK {
+		t.Fatalf("Expected state, got %d", code)
+	}
+
+	states := struct {
+		Targets []map[string]interface{}
+	}{}
+	if err := json.Unmarshal([]byte(body), &states); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(states.Targets) != 1 {
+		t.Fatalf("Expected one target, got %s", body)
+	}
+	state := states.Targets[0]
+	if state["target"] != "/etc/hosts" || state["version"] != "42" || state["lastUpdate"] != "2016-01-02T03:04:05Z" {
+		t.Fatalf("Unexpected state %s", body)
+	}
+	if state["entries"].(map[string]interface{})["host1"] != "10.1.0.1" {
+		t.Fatalf("Expected host1 in the entries, got %s", body)
+	}
+	if state["duplicates"].([]interface{})[0].(map[string]interface{})["name"] != "host2" {
+		t.Fatalf("Expected host2 in the duplicates, got %s", body)
+	}
+}
@@ -0,0 +1,83 @@
+package updater
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AddressFamily selects which kind of addresses are published
+type AddressFamily string
+
+const (
+	FamilyBoth AddressFamily = "both"
+	FamilyIPv4 AddressFamily = "v4"
+	FamilyIPv6 AddressFamily = "v6"
+)
+
+// ParseAddressFamily validates an address family given on the command line
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch family := AddressFamily(s); family {
+	case FamilyBoth, FamilyIPv4, FamilyIPv6:
+		return family, nil
+	}
+	return "", fmt.Errorf("Invalid address family %q, expected one of %s, %s or %s", s, FamilyBoth, FamilyIPv4, FamilyIPv6)
+}
+
+func (f AddressFamily) allows(ip net.IP) bool {
+	switch f {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// addresses returns the valid addresses of the object called name: ips
+// plus those listed in its AddressLabels, in canonical form, without
+// duplicates or addresses of a family that is not published. IPv4
+// addresses come first.
+func (u *Updater) addresses(name string, ips []string, labels map[string]string) []string {
+	candidates := append([]string{}, ips...)
+	for _, key := range u.AddressLabels {
+		candidates = append(candidates, strings.FieldsFunc(labels[key], func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+
+	addresses := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		ip := net.ParseIP(candidate)
+		if ip == nil {
+			log.Warnf("Skipping invalid address %q of %s", candidate, name)
+			continue
+		}
+		if !u.AddressFamily.allows(ip) {
+			continue
+		}
+		address := ip.String()
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		addresses = append(addresses, address)
+	}
+
+	sort.Stable(byFamily(addresses))
+	return addresses
+}
+
+// byFamily moves IPv4 addresses before IPv6 ones, keeping the order
+// within each family
+type byFamily []string
+
+func (a byFamily) Len() int      { return len(a) }
+func (a byFamily) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFamily) Less(i, j int) bool {
+	return !strings.Contains(a[i], ":") && strings.Contains(a[j], ":")
+}
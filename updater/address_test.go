@@ -0,0 +1,83 @@
+package updater
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestAddresses(t *testing.T) {
+	labels := map[string]string{
+		"ipv6":  "fd00:0::1, fd00::2",
+		"extra": "10.0.0.3,not-an-ip",
+	}
+	cases := []struct {
+		family   AddressFamily
+		labels   []string
+		ips      []string
+		expected []string
+	}{
+		{"", nil, []string{"10.0.0.1"}, []string{"10.0.0.1"}},
+		{"", nil, []string{"IP1", "", "10.0.0.1", "10.0.0.1"}, []string{"10.0.0.1"}},
+		{"", []string{"ipv6"}, []string{"10.0.0.1"}, []string{"10.0.0.1", "fd00::1", "fd00::2"}},
+		{"", []string{"ipv6", "extra"}, []string{"fd00::9", "10.0.0.1"}, []string{"10.0.0.1", "10.0.0.3", "fd00::9", "fd00::1", "fd00::2"}},
+		{FamilyIPv4, []string{"ipv6"}, []string{"10.0.0.1"}, []string{"10.0.0.1"}},
+		{FamilyIPv6, []string{"ipv6"}, []string{"10.0.0.1"}, []string{"fd00::1", "fd00::2"}},
+		{FamilyIPv6, nil, []string{"10.0.0.1"}, []string{}},
+		{"", []string{"missing"}, []string{"::ffff:10.0.0.1"}, []string{"10.0.0.1"}},
+	}
+	for _, c := range cases {
+		u := &Updater{
+			AddressFamily: c.family,
+			AddressLabels: c.labels,
+		}
+		if addresses := u.addresses("test", c.ips, labels); !reflect.DeepEqual(addresses, c.expected) {
+			t.Fatalf("Expected %v for %v with family %q and labels %v, found %v", c.expected, c.ips, c.family, c.labels, addresses)
+		}
+	}
+}
+
+func TestParseAddressFamily(t *testing.T) {
+	for _, s := range []string{"both", "v4", "v6"} {
+		if _, err := ParseAddressFamily(s); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if _, err := ParseAddressFamily("ipv4"); err == nil {
+		t.Fatalf("Expected invalid address family to be rejected")
+	}
+}
+
+func TestPublishesEveryAddress(t *testing.T) {
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "dual",
+					AgentIP:  "10.0.0.1",
+					Labels:   map[string]string{"io.rancher.host.ipv6": "fd00::1"},
+				},
+				{
+					Hostname: "broken",
+					AgentIP:  "IP1",
+				},
+			},
+		},
+		AddressLabels: []string{"io.rancher.host.ipv6"},
+		Writer:        w,
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+	}
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expected := beginMarker + "\n127.0.0.1    localhost\n10.0.0.1    dual\nfd00::1    dual\n" + endMarker + "\n"
+	if string(w.data) != expected {
+		t.Fatalf("Expected\n%q\nfound\n%q", expected, string(w.data))
+	}
+}
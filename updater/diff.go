@@ -0,0 +1,136 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// unifiedDiff returns the line based unified diff turning a into b, or ""
+// when they are equal. Hosts files are small, so a plain LCS table is used.
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	linesA, linesB := splitLines(string(a)), splitLines(string(b))
+	ops := diffOps(linesA, linesB)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Changes with fewer than two contexts of equal lines between them
+		// share a hunk
+		last := i
+		for j := i; j < len(ops) && j-last <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		start, stop := i-diffContext, last+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		writeHunk(buf, ops[start:stop], linesA, linesB)
+		i = stop
+	}
+	return buf.String()
+}
+
+func writeHunk(buf *bytes.Buffer, ops []diffOp, linesA, linesB []string) {
+	countA, countB := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			countA++
+		}
+		if op.kind != '-' {
+			countB++
+		}
+	}
+	startA, startB := ops[0].a, ops[0].b
+	if countA > 0 {
+		startA++
+	}
+	if countB > 0 {
+		startB++
+	}
+	fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+
+	for _, op := range ops {
+		line := ""
+		switch op.kind {
+		case '+':
+			line = linesB[op.b]
+		default:
+			line = linesA[op.a]
+		}
+		buf.WriteByte(op.kind)
+		buf.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// diffOps returns the edit script from a to b. Every op carries its
+// position in both inputs, so hunk headers can be derived from it.
+func diffOps(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		}
+	}
+	return ops
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
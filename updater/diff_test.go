@@ -0,0 +1,99 @@
+package updater
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n15\n16\n"
+	expected := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
+ 15
++16
+`
+	if diff := unifiedDiff("a", "b", []byte(a), []byte(b)); diff != expected {
+		t.Fatalf("Expected\n%s\nfound\n%s", expected, diff)
+	}
+}
+
+func TestUnifiedDiffEdgeCases(t *testing.T) {
+	if diff := unifiedDiff("a", "b", []byte("x\n"), []byte("x\n")); diff != "" {
+		t.Fatalf("Expected no diff for equal input, found\n%s", diff)
+	}
+
+	expected := "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x\n"
+	if diff := unifiedDiff("a", "b", nil, []byte("x\n")); diff != expected {
+		t.Fatalf("Expected\n%s\nfound\n%s", expected, diff)
+	}
+
+	expected = "--- a\n+++ b\n@@ -1,1 +1,1 @@\n-x\n\\ No newline at end of file\n+x\n"
+	if diff := unifiedDiff("a", "b", []byte("x"), []byte("x\n")); diff != expected {
+		t.Fatalf("Expected\n%s\nfound\n%s", expected, diff)
+	}
+}
+
+func TestRenderAndDiffDoNotWrite(t *testing.T) {
+	orig := "127.0.0.1 localhost\n"
+	w := &memWriter{data: []byte(orig)}
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+				},
+			},
+		},
+		self: []Entry{{
+			IP:    "10.0.0.2",
+			Names: []string{"self"},
+		}},
+		Writer: w,
+	}
+
+	rendered, err := u.Render()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := orig + beginMarker + "\n10.0.0.2    self\n10.1.0.1    Host1\n" + endMarker + "\n"
+	if string(rendered) != expected {
+		t.Fatalf("Expected\n%q\nfound\n%q", expected, string(rendered))
+	}
+
+	diff, err := u.Diff()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = "--- memory\n+++ memory.new\n@@ -1,1 +1,5 @@\n 127.0.0.1 localhost\n+" +
+		beginMarker + "\n+10.0.0.2    self\n+10.1.0.1    Host1\n+" + endMarker + "\n"
+	if diff != expected {
+		t.Fatalf("Expected\n%s\nfound\n%s", expected, diff)
+	}
+	if w.writes != 0 {
+		t.Fatalf("Expected Render and Diff not to write")
+	}
+
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if diff, err := u.Diff(); err != nil || diff != "" {
+		t.Fatalf("Expected no diff after Sync, found %q %v", diff, err)
+	}
+}
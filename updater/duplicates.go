@@ -0,0 +1,194 @@
+package updater
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DuplicatePolicy decides what is published for a name claimed by more than
+// one record
+type DuplicatePolicy string
+
+const (
+	// DuplicateFirst publishes the record metadata returned first
+	DuplicateFirst DuplicatePolicy = "first"
+	// DuplicateLowestID publishes the record with the lowest ID, the oldest
+	// host, container or service
+	DuplicateLowestID DuplicatePolicy = "lowest-id"
+	// DuplicateNewest publishes the record with the highest ID
+	DuplicateNewest DuplicatePolicy = "newest"
+	// DuplicateAll publishes the addresses of every record under the name
+	DuplicateAll DuplicatePolicy = "all"
+	// DuplicateSuffix publishes every record under the name with a dash and
+	// the first characters of its UUID appended to the first label
+	DuplicateSuffix DuplicatePolicy = "suffix"
+)
+
+// suffixLength is the number of UUID characters used by DuplicateSuffix
+const suffixLength = 8
+
+// ParseDuplicatePolicy validates a duplicate policy given on the command line
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(s); policy {
+	case DuplicateFirst, DuplicateLowestID, DuplicateNewest, DuplicateAll, DuplicateSuffix:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Invalid duplicate policy %q, expected one of %s, %s, %s, %s or %s", s,
+		DuplicateFirst, DuplicateLowestID, DuplicateNewest, DuplicateAll, DuplicateSuffix)
+}
+
+// Duplicate is a name claimed by more than one record
+type Duplicate struct {
+	Name string `json:"name"`
+	// Claims holds the addresses of every record with the name, in
+	// metadata order
+	Claims []string `json:"claims"`
+}
+
+func (d Duplicate) String() string {
+	return fmt.Sprintf("%s claimed by %s", d.Name, strings.Join(d.Claims, " and "))
+}
+
+// publish resolves the names claimed by several records according to
+// policy, and drops records left without names. It returns the remaining
+// records, a map of every published name to its addresses, and the
+// duplicated names sorted by name.
+func publish(records []Record, policy DuplicatePolicy) ([]Record, map[string]string, []Duplicate) {
+	claimants := map[string][]int{}
+	for i, record := range records {
+		for _, name := range record.Names {
+			claimants[name] = append(claimants[name], i)
+		}
+	}
+
+	// published[i] maps the names of records[i] to the names it publishes
+	// them as, a name missing from it is not published for the record
+	published := make([]map[string]string, len(records))
+	for i := range published {
+		published[i] = map[string]string{}
+	}
+	duplicates := []Duplicate{}
+	for name, indexes := range claimants {
+		if len(indexes) == 1 {
+			published[indexes[0]][name] = name
+			continue
+		}
+
+		duplicate := Duplicate{Name: name}
+		for _, i := range indexes {
+			duplicate.Claims = append(duplicate.Claims, strings.Join(records[i].IPs, ","))
+		}
+		duplicates = append(duplicates, duplicate)
+
+		switch policy {
+		case DuplicateAll:
+			for _, i := range indexes {
+				published[i][name] = name
+			}
+		case DuplicateSuffix:
+			for _, i := range indexes {
+				suffixed := suffixName(name, records[i].suffix())
+				if !validHostname(suffixed) {
+					log.Warnf("Not publishing %s, the disambiguated name is invalid", suffixed)
+					continue
+				}
+				published[i][name] = suffixed
+			}
+		default:
+			published[winner(records, indexes, policy)][name] = name
+		}
+	}
+	sort.Sort(duplicateSorter(duplicates))
+
+	hostsMap := map[string]string{}
+	result := []Record{}
+	for i, record := range records {
+		names := []string{}
+		for _, name := range record.Names {
+			publishedName, ok := published[i][name]
+			if !ok {
+				continue
+			}
+			if _, ok := hostsMap[publishedName]; ok && policy != DuplicateAll {
+				// A suffixed name taken by another record
+				continue
+			}
+			hostsMap[publishedName] = joinIPs(hostsMap[publishedName], record.IPs)
+			names = append(names, publishedName)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		record.Names = names
+		result = append(result, record)
+	}
+	return result, hostsMap, duplicates
+}
+
+// winner returns the index of the record publishing a duplicated name
+// under a policy that picks one of them
+func winner(records []Record, indexes []int, policy DuplicatePolicy) int {
+	best := indexes[0]
+	for _, i := range indexes[1:] {
+		switch policy {
+		case DuplicateLowestID:
+			if records[i].ID < records[best].ID {
+				best = i
+			}
+		case DuplicateNewest:
+			if records[i].ID > records[best].ID {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// suffix tells apart records with the same name, the ID stands in for a
+// missing UUID
+func (r Record) suffix() string {
+	suffix := strings.ToLower(strings.Replace(r.UUID, "-", "", -1))
+	if suffix == "" {
+		return strconv.Itoa(r.ID)
+	}
+	if len(suffix) > suffixLength {
+		suffix = suffix[:suffixLength]
+	}
+	return suffix
+}
+
+// suffixName appends suffix to the first label of name, keeping the domain
+func suffixName(name, suffix string) string {
+	parts := strings.SplitN(name, ".", 2)
+	parts[0] += "-" + suffix
+	return strings.Join(parts, ".")
+}
+
+// joinIPs adds the addresses in ips missing from the comma separated list
+// joined
+func joinIPs(joined string, ips []string) string {
+	if joined == "" {
+		return strings.Join(ips, ",")
+	}
+	all := strings.Split(joined, ",")
+	for _, ip := range ips {
+		found := false
+		for _, existing := range all {
+			found = found || existing == ip
+		}
+		if !found {
+			all = append(all, ip)
+		}
+	}
+	return strings.Join(all, ",")
+}
+
+type duplicateSorter []Duplicate
+
+func (s duplicateSorter) Len() int           { return len(s) }
+func (s duplicateSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s duplicateSorter) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,121 @@
+package updater
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func duplicateRecords() []Record {
+	return []Record{
+		{Names: []string{"web", "web1"}, IPs: []string{"10.1.0.1"}, ID: 5, UUID: "AAAAAAAA-1111"},
+		{Names: []string{"db"}, IPs: []string{"10.1.0.2"}, ID: 2, UUID: "bbbbbbbb-2222"},
+		{Names: []string{"web.example.com", "web"}, IPs: []string{"10.1.0.3", "fd00::3"}, ID: 9, UUID: "cccccccc-3333"},
+		{Names: []string{"web"}, IPs: []string{"10.1.0.4"}, ID: 1},
+	}
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	for _, s := range []string{"first", "lowest-id", "newest", "all", "suffix"} {
+		if policy, err := ParseDuplicatePolicy(s); err != nil || string(policy) != s {
+			t.Fatalf("Expected %s to parse, got %q %v", s, policy, err)
+		}
+	}
+	if _, err := ParseDuplicatePolicy("last"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
+
+func TestPublishDuplicatePolicies(t *testing.T) {
+	tests := []struct {
+		policy   DuplicatePolicy
+		hostsMap map[string]string
+		names    [][]string
+	}{
+		{
+			policy: DuplicateFirst,
+			hostsMap: map[string]string{
+				"web": "10.1.0.1", "web1": "10.1.0.1", "db": "10.1.0.2", "web.example.com": "10.1.0.3,fd00::3",
+			},
+			names: [][]string{{"web", "web1"}, {"db"}, {"web.example.com"}},
+		},
+		{
+			policy: DuplicateLowestID,
+			hostsMap: map[string]string{
+				"web": "10.1.0.4", "web1": "10.1.0.1", "db": "10.1.0.2", "web.example.com": "10.1.0.3,fd00::3",
+			},
+			names: [][]string{{"web1"}, {"db"}, {"web.example.com"}, {"web"}},
+		},
+		{
+			policy: DuplicateNewest,
+			hostsMap: map[string]string{
+				"web": "10.1.0.3,fd00::3", "web1": "10.1.0.1", "db": "10.1.0.2", "web.example.com": "10.1.0.3,fd00::3",
+			},
+			names: [][]string{{"web1"}, {"db"}, {"web.example.com", "web"}},
+		},
+		{
+			policy: DuplicateAll,
+			hostsMap: map[string]string{
+				"web": "10.1.0.1,10.1.0.3,fd00::3,10.1.0.4", "web1": "10.1.0.1", "db": "10.1.0.2", "web.example.com": "10.1.0.3,fd00::3",
+			},
+			names: [][]string{{"web", "web1"}, {"db"}, {"web.example.com", "web"}, {"web"}},
+		},
+		{
+			policy: DuplicateSuffix,
+			hostsMap: map[string]string{
+				"web-aaaaaaaa": "10.1.0.1", "web1": "10.1.0.1", "db": "10.1.0.2", "web.example.com": "10.1.0.3,fd00::3",
+				"web-cccccccc": "10.1.0.3,fd00::3", "web-1": "10.1.0.4",
+			},
+			names: [][]string{{"web-aaaaaaaa", "web1"}, {"db"}, {"web.example.com", "web-cccccccc"}, {"web-1"}},
+		},
+	}
+
+	for _, test := range tests {
+		published, hostsMap, duplicates := publish(duplicateRecords(), test.policy)
+		if !reflect.DeepEqual(hostsMap, test.hostsMap) {
+			t.Fatalf("%s: expected %v, got %v", test.policy, test.hostsMap, hostsMap)
+		}
+		names := [][]string{}
+		for _, record := range published {
+			names = append(names, record.Names)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Fatalf("%s: expected names %v, got %v", test.policy, test.names, names)
+		}
+
+		expected := []Duplicate{{Name: "web", Claims: []string{"10.1.0.1", "10.1.0.3,fd00::3", "10.1.0.4"}}}
+		if !reflect.DeepEqual(duplicates, expected) {
+			t.Fatalf("%s: expected duplicates %v, got %v", test.policy, expected, duplicates)
+		}
+	}
+}
+
+func TestSuffixNameKeepsDomain(t *testing.T) {
+	if name := suffixName("web.example.com", "abc"); name != "web-abc.example.com" {
+		t.Fatalf("Expected web-abc.example.com, got %s", name)
+	}
+}
+
+func TestUpdateReportsDuplicates(t *testing.T) {
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{Hostname: "Host1", AgentIP: "10.1.0.1", HostId: 2},
+				{Hostname: "Host1", AgentIP: "10.1.0.2", HostId: 1},
+			},
+		},
+		Writer:          &memWriter{},
+		DuplicatePolicy: DuplicateLowestID,
+		self:            []Entry{},
+	}
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if u.rancherHosts["Host1"] != "10.1.0.2" {
+		t.Fatalf("Expected the host with the lowest id to be published, got %v", u.rancherHosts)
+	}
+	if len(u.Duplicates()) != 1 || u.Duplicates()[0].String() != "Host1 claimed by 10.1.0.1 and 10.1.0.2" {
+		t.Fatalf("Expected Host1 to be reported as duplicate, got %v", u.Duplicates())
+	}
+}
@@ -0,0 +1,339 @@
+package updater
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// Group updates several targets, each an Updater with its own output and
+// settings, from a single metadata fetch per cycle. A target failing does
+// not keep the others from being updated.
+type Group struct {
+	MetadataClient MetadataClient
+
+	// lock guards Targets against Reconfigure while Status is read
+	lock    sync.RWMutex
+	Targets []*Updater
+}
+
+// NewGroup returns a group updating targets. Their MetadataClient is set by
+// the group on every cycle.
+func NewGroup(client MetadataClient, targets ...*Updater) *Group {
+	return &Group{
+		MetadataClient: client,
+		Targets:        targets,
+	}
+}
+
+func (g *Group) targets() []*Updater {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return append([]*Updater{}, g.Targets...)
+}
+
+// each calls do for every target with a metadata client sharing one fetch
+// between them, and returns the errors of all targets joined
+func (g *Group) each(do func(u *Updater) error) error {
+	client := newSnapshot(g.MetadataClient)
+	failures := []string{}
+	for _, u := range g.targets() {
+		u.MetadataClient = client
+		if err := do(u); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", u.writer(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Run updates every target, logging the failures
+func (g *Group) Run(version string) {
+	g.each(func(u *Updater) error {
+		u.Run(version)
+		return nil
+	})
+}
+
+// Sync updates every target once
+func (g *Group) Sync() error {
+	return g.each(func(u *Updater) error {
+		return u.Sync()
+	})
+}
+
+// Render returns the content every target would get. With more than one
+// target each content is preceded by a line naming the target.
+func (g *Group) Render() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	targets := g.targets()
+	err := g.each(func(u *Updater) error {
+		data, err := u.Render()
+		if err != nil {
+			return err
+		}
+		if len(targets) > 1 {
+			fmt.Fprintf(buf, "==> %s <==\n", u.writer())
+		}
+		buf.Write(data)
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// Diff returns the diffs of every target
+func (g *Group) Diff() (string, error) {
+	diffs := ""
+	err := g.each(func(u *Updater) error {
+		diff, err := u.Diff()
+		diffs += diff
+		return err
+	})
+	return diffs, err
+}
+
+// Restore puts back the original content of every target
+func (g *Group) Restore() error {
+	return g.each(func(u *Updater) error {
+		return u.Restore()
+	})
+}
+
+// Repair repairs the rancher-managed block of every target changed by
+// another program, see Updater.Repair
+func (g *Group) Repair() error {
+	return g.each(func(u *Updater) error {
+		return u.Repair()
+	})
+}
+
+// States returns the state of every target that had a successful update,
+// by target
+func (g *Group) States() map[string]State {
+	states := map[string]State{}
+	for _, u := range g.targets() {
+		if state, ok := u.State(); ok {
+			states[u.writer().String()] = state
+		}
+	}
+	return states
+}
+
+// ApplyStates writes the states of the targets found in states, see
+// Updater.ApplyState
+func (g *Group) ApplyStates(states map[string]State) error {
+	return g.each(func(u *Updater) error {
+		state, ok := states[u.writer().String()]
+		if !ok {
+			return nil
+		}
+		log.Infof("Applying the state of %s from metadata version %s of %s", u.writer(), state.Version, state.Updated.Format(time.RFC3339))
+		return u.ApplyState(state)
+	})
+}
+
+// MetadataError records an error reading metadata on every target
+func (g *Group) MetadataError(err error) {
+	for _, u := range g.targets() {
+		u.MetadataError(err)
+	}
+}
+
+// MetadataReached records reading metadata on every target
+func (g *Group) MetadataReached() {
+	for _, u := range g.targets() {
+		u.MetadataReached()
+	}
+}
+
+// Reconfigure replaces the targets with those of next. A target writing
+// the same output as a current one takes over its state, see
+// Updater.Reconfigure; the outputs of dropped targets are left as they are.
+func (g *Group) Reconfigure(next *Group) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	current := map[string]*Updater{}
+	for _, u := range g.Targets {
+		current[u.writer().String()] = u
+	}
+	targets := []*Updater{}
+	for _, u := range next.Targets {
+		if existing, ok := current[u.writer().String()]; ok {
+			existing.Reconfigure(u)
+			u = existing
+		} else {
+			log.Infof("Adding target %s", u.writer())
+		}
+		targets = append(targets, u)
+	}
+	g.Targets = targets
+}
+
+// Status returns the status of every target
+func (g *Group) Status() GroupStatus {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	s := GroupStatus{}
+	for _, u := range g.Targets {
+		status := u.Status()
+		status.Target = u.writer().String()
+		s.Targets = append(s.Targets, status)
+	}
+	return s
+}
+
+// Metrics returns the metrics of every target
+func (g *Group) Metrics() []Metrics {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	metrics := []Metrics{}
+	for _, u := range g.Targets {
+		m := u.Metrics()
+		m.Target = u.writer().String()
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// GroupStatus is the status of every target of a Group
+type GroupStatus struct {
+	Targets []Status `json:"targets"`
+}
+
+// Holding reports whether the removal guard of a target holds back an
+// update
+func (s GroupStatus) Holding() bool {
+	for _, status := range s.Targets {
+		if status.Holding {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready reports whether every target had a successful update
+func (s GroupStatus) Ready() bool {
+	for _, status := range s.Targets {
+		if !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot is a MetadataClient answering each request from the first
+// answer of client, so all targets of a cycle see the same metadata
+type snapshot struct {
+	client MetadataClient
+
+	selfContainer *metadata.Container
+	selfHost      *metadata.Host
+	hosts         *[]metadata.Host
+	containers    *[]metadata.Container
+	services      *[]metadata.Service
+	errors        map[string]error
+}
+
+func newSnapshot(client MetadataClient) *snapshot {
+	return &snapshot{
+		client: client,
+		errors: map[string]error{},
+	}
+}
+
+// fetch calls get the first time key is asked for, failures are remembered
+// as well
+func (s *snapshot) fetch(key string, done bool, get func() error) error {
+	if done {
+		return nil
+	}
+	if err, ok := s.errors[key]; ok {
+		return err
+	}
+	err := get()
+	if err != nil {
+		s.errors[key] = err
+	}
+	return err
+}
+
+func (s *snapshot) GetSelfContainer() (metadata.Container, error) {
+	err := s.fetch("self-container", s.selfContainer != nil, func() error {
+		container, err := s.client.GetSelfContainer()
+		if err == nil {
+			s.selfContainer = &container
+		}
+		return err
+	})
+	if err != nil {
+		return metadata.Container{}, err
+	}
+	return *s.selfContainer, nil
+}
+
+func (s *snapshot) GetSelfHost() (metadata.Host, error) {
+	err := s.fetch("self-host", s.selfHost != nil, func() error {
+		host, err := s.client.GetSelfHost()
+		if err == nil {
+			s.selfHost = &host
+		}
+		return err
+	})
+	if err != nil {
+		return metadata.Host{}, err
+	}
+	return *s.selfHost, nil
+}
+
+func (s *snapshot) GetHosts() ([]metadata.Host, error) {
+	err := s.fetch("hosts", s.hosts != nil, func() error {
+		hosts, err := s.client.GetHosts()
+		if err == nil {
+			s.hosts = &hosts
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *s.hosts, nil
+}
+
+func (s *snapshot) GetContainers() ([]metadata.Container, error) {
+	err := s.fetch("containers", s.containers != nil, func() error {
+		containers, err := s.client.GetContainers()
+		if err == nil {
+			s.containers = &containers
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *s.containers, nil
+}
+
+func (s *snapshot) GetServices() ([]metadata.Service, error) {
+	err := s.fetch("services", s.services != nil, func() error {
+		services, err := s.client.GetServices()
+		if err == nil {
+			s.services = &services
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *s.services, nil
+}
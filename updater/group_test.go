@@ -0,0 +1,134 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// countingClient counts the host requests
+type countingClient struct {
+	fakeMetadataClient
+	hostRequests int
+}
+
+func (c *countingClient) GetHosts() ([]metadata.Host, error) {
+	c.hostRequests++
+	return c.fakeMetadataClient.GetHosts()
+}
+
+// namedWriter is a memWriter with a name, as targets are told apart by it
+type namedWriter struct {
+	memWriter
+	name string
+}
+
+func (n *namedWriter) String() string {
+	return n.name
+}
+
+func TestGroupSharesFetch(t *testing.T) {
+	client := &countingClient{
+		fakeMetadataClient: fakeMetadataClient{
+			hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+		},
+	}
+	hosts := &namedWriter{name: "hosts"}
+	dnsmasq := &namedWriter{name: "dnsmasq"}
+	g := NewGroup(client,
+		&Updater{Writer: hosts, self: []Entry{}},
+		&Updater{Writer: dnsmasq, Renderer: DnsmasqRenderer{}, self: []Entry{}},
+	)
+
+	g.Run("1")
+	if client.hostRequests != 1 {
+		t.Fatalf("Expected one host request for both targets, found %d", client.hostRequests)
+	}
+	if !strings.Contains(string(hosts.data), "10.1.0.1    Host1") {
+		t.Fatalf("Expected Host1 in the hosts target, found %q", string(hosts.data))
+	}
+	if !strings.Contains(string(dnsmasq.data), "host-record=Host1,10.1.0.1") {
+		t.Fatalf("Expected Host1 in the dnsmasq target, found %q", string(dnsmasq.data))
+	}
+
+	g.Run("2")
+	if client.hostRequests != 2 {
+		t.Fatalf("Expected a new fetch for the next cycle, found %d requests", client.hostRequests)
+	}
+}
+
+func TestGroupTargetFailureDoesNotBlockOthers(t *testing.T) {
+	broken := &failingWriter{fail: true}
+	working := &namedWriter{name: "working"}
+	g := NewGroup(client,
+		&Updater{Writer: broken, self: []Entry{}},
+		&Updater{Writer: working, self: []Entry{}},
+	)
+
+	err := g.Sync()
+	if err == nil || !strings.Contains(err.Error(), "memory: disk full") {
+		t.Fatalf("Expected the failing target to be reported, got %v", err)
+	}
+	if working.writes != 1 {
+		t.Fatalf("Expected the working target to be written")
+	}
+
+	status := g.Status()
+	if len(status.Targets) != 2 || status.Ready() {
+		t.Fatalf("Expected two targets, not all ready, got %+v", status)
+	}
+	if status.Targets[0].Target != "memory" || status.Targets[0].WriteSucceeded {
+		t.Fatalf("Expected the failed write of the first target, got %+v", status.Targets[0])
+	}
+	if status.Targets[1].Target != "working" || !status.Targets[1].Ready {
+		t.Fatalf("Expected the second target to be ready, got %+v", status.Targets[1])
+	}
+	if metrics := g.Metrics(); len(metrics) != 2 || metrics[0].WriteFailures != 1 || metrics[1].Target != "working" {
+		t.Fatalf("Expected metrics per target, got %+v", metrics)
+	}
+}
+
+func TestGroupReconfigureKeepsState(t *testing.T) {
+	kept := &Updater{Writer: &namedWriter{name: "kept"}, self: []Entry{}}
+	dropped := &Updater{Writer: &namedWriter{name: "dropped"}, self: []Entry{}}
+	g := NewGroup(client, kept, dropped)
+	g.Run("1")
+
+	added := &Updater{Writer: &namedWriter{name: "added"}, self: []Entry{}}
+	g.Reconfigure(NewGroup(nil,
+		&Updater{Writer: &namedWriter{name: "kept"}, SortOrder: SortByIP},
+		added,
+	))
+
+	if len(g.Targets) != 2 || g.Targets[0] != kept || g.Targets[1] != added {
+		t.Fatalf("Expected the kept and the added target, found %v", g.Targets)
+	}
+	if kept.SortOrder != SortByIP || len(kept.Status().Entries) != 1 {
+		t.Fatalf("Expected the kept target to have the new settings and its state")
+	}
+}
+
+func TestSnapshotRemembersErrors(t *testing.T) {
+	failing := &erroringClient{}
+	s := newSnapshot(failing)
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetHosts(); err == nil {
+			t.Fatalf("Expected the error to be returned")
+		}
+	}
+	if failing.requests != 1 {
+		t.Fatalf("Expected one request, found %d", failing.requests)
+	}
+}
+
+type erroringClient struct {
+	fakeMetadataClient
+	requests int
+}
+
+func (e *erroringClient) GetHosts() ([]metadata.Host, error) {
+	e.requests++
+	return nil, fmt.Errorf("connection refused")
+}
@@ -0,0 +1,37 @@
+package updater
+
+// RemovalGuard holds back updates that remove many entries at once, which
+// usually means metadata answered with a partial list while restarting.
+// An update exceeding MaxRemovals or MaxRemovalPercent is only applied
+// once it was seen HoldCycles times in a row. Zero limits are disabled.
+type RemovalGuard struct {
+	MaxRemovals       int
+	MaxRemovalPercent int
+	HoldCycles        int
+	held              int
+}
+
+// hold reports whether an update removing removed of total entries has to
+// be held back in this cycle
+func (g *RemovalGuard) hold(removed, total int) bool {
+	if !g.exceeded(removed, total) {
+		g.held = 0
+		return false
+	}
+	g.held++
+	if g.held >= g.HoldCycles {
+		g.held = 0
+		return false
+	}
+	return true
+}
+
+func (g *RemovalGuard) exceeded(removed, total int) bool {
+	if removed == 0 {
+		return false
+	}
+	if g.MaxRemovals > 0 && removed > g.MaxRemovals {
+		return true
+	}
+	return g.MaxRemovalPercent > 0 && removed*100 > g.MaxRemovalPercent*total
+}
@@ -0,0 +1,99 @@
+package updater
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestRemovalGuardHold(t *testing.T) {
+	g := &RemovalGuard{MaxRemovals: 2, MaxRemovalPercent: 50, HoldCycles: 3}
+	cases := []struct {
+		removed, total int
+		hold           bool
+	}{
+		{0, 10, false},
+		{2, 10, false},
+		{3, 10, true},
+		{3, 10, true},
+		{3, 10, false},
+		{3, 10, true},
+		{1, 10, false},
+		{2, 3, true},
+		{1, 1, true},
+		{1, 1, false},
+	}
+	for i, c := range cases {
+		if hold := g.hold(c.removed, c.total); hold != c.hold {
+			t.Fatalf("Case %d: expected hold of %d/%d removals to be %v", i, c.removed, c.total, c.hold)
+		}
+	}
+
+	disabled := &RemovalGuard{}
+	if disabled.hold(10, 10) {
+		t.Fatalf("Expected the zero guard never to hold")
+	}
+}
+
+func TestGuardHoldsFlappingRemovals(t *testing.T) {
+	all := []metadata.Host{
+		{Hostname: "Host1", AgentIP: "10.1.0.1"},
+		{Hostname: "Host2", AgentIP: "10.1.0.2"},
+		{Hostname: "Host3", AgentIP: "10.1.0.3"},
+		{Hostname: "Host4", AgentIP: "10.1.0.4"},
+	}
+	client := &fakeMetadataClient{hosts: all}
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: client,
+		Writer:         w,
+		Guard:          RemovalGuard{MaxRemovalPercent: 50, HoldCycles: 3},
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+	}
+
+	assertHosts := func(expected int) {
+		hostsMap, err := parseHostsOrigFile(w)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		// localhost is always there
+		if len(hostsMap) != expected+1 {
+			t.Fatalf("Expected %d hosts, found %d", expected, len(hostsMap)-1)
+		}
+	}
+
+	u.Run("")
+	assertHosts(4)
+
+	// metadata flaps to an empty list and back
+	updated := u.Status().LastUpdate
+	client.hosts = nil
+	u.Run("")
+	u.Run("")
+	assertHosts(4)
+	if s, m := u.Status(), u.Metrics(); !s.Holding || m.Holds != 2 || !s.LastUpdate.Equal(updated) {
+		t.Fatalf("Expected two held updates that are not successes, got %+v and %+v", s, m)
+	}
+	client.hosts = all
+	u.Run("")
+	assertHosts(4)
+	if u.Status().Holding {
+		t.Fatalf("Expected nothing to be held once metadata is back")
+	}
+
+	// removing half of the hosts is within the limit
+	client.hosts = all[:2]
+	u.Run("")
+	assertHosts(2)
+
+	// an empty list that persists is applied on the third cycle
+	client.hosts = nil
+	u.Run("")
+	u.Run("")
+	assertHosts(2)
+	u.Run("")
+	assertHosts(0)
+}
@@ -0,0 +1,151 @@
+package updater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	beginMarker = "# BEGIN rancher-managed"
+	endMarker   = "# END rancher-managed"
+)
+
+// Entry is a single address line of a hosts file
+type Entry struct {
+	IP    string   `json:"ip"`
+	Names []string `json:"names"`
+}
+
+func (e Entry) String() string {
+	return e.IP + "    " + strings.Join(e.Names, " ")
+}
+
+// ParseEntry parses one hosts file line. It returns false for blank lines,
+// comments and lines that do not carry at least an address and a name.
+func ParseEntry(line string) (Entry, bool) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Entry{}, false
+	}
+	return Entry{
+		IP:    fields[0],
+		Names: fields[1:],
+	}, true
+}
+
+// HostsFile is a parsed hosts file. Only the region between the
+// rancher-managed markers belongs to the updater, everything before and
+// after it is kept byte-for-byte.
+type HostsFile struct {
+	head     string
+	tail     string
+	managed  []Entry
+	hasBlock bool
+}
+
+// ParseHosts splits data around the rancher-managed block. A begin marker
+// without a matching end marker is treated as a block running to the end
+// of the file, so a truncated write is repaired by the next update.
+func ParseHosts(data []byte) *HostsFile {
+	h := &HostsFile{}
+	text := string(data)
+
+	start, end := -1, len(text)
+	for offset := 0; offset < len(text); {
+		lineEnd := len(text)
+		if next := strings.IndexByte(text[offset:], '\n'); next >= 0 {
+			lineEnd = offset + next + 1
+		}
+		line := strings.TrimSpace(text[offset:lineEnd])
+
+		if start < 0 {
+			if line == beginMarker {
+				start = offset
+				h.hasBlock = true
+			}
+		} else if line == endMarker {
+			end = lineEnd
+			break
+		} else if entry, ok := ParseEntry(line); ok {
+			h.managed = append(h.managed, entry)
+		}
+		offset = lineEnd
+	}
+
+	if start < 0 {
+		h.head = text
+		return h
+	}
+	h.head = text[:start]
+	h.tail = text[end:]
+	return h
+}
+
+// ReadHostsFile parses the hosts file at path. A missing file is treated
+// as an empty one.
+func ReadHostsFile(path string) (*HostsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ParseHosts(nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseHosts(data), nil
+}
+
+// Managed returns the entries inside the rancher-managed block
+func (h *HostsFile) Managed() []Entry {
+	return h.managed
+}
+
+// SetManaged replaces the content of the rancher-managed block, adding the
+// block to the end of the file if it was not there yet.
+func (h *HostsFile) SetManaged(entries []Entry) {
+	h.managed = entries
+	h.hasBlock = true
+}
+
+// Entries returns every address line of the file, in file order
+func (h *HostsFile) Entries() []Entry {
+	var entries []Entry
+	for _, line := range strings.Split(h.head, "\n") {
+		if entry, ok := ParseEntry(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	entries = append(entries, h.managed...)
+	for _, line := range strings.Split(h.tail, "\n") {
+		if entry, ok := ParseEntry(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Bytes serializes the file back to its on-disk form
+func (h *HostsFile) Bytes() []byte {
+	return h.Render(HostsRenderer{})
+}
+
+// Render serializes the file with the rancher-managed block in the format
+// of r
+func (h *HostsFile) Render(r Renderer) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(h.head)
+	if !h.hasBlock {
+		return buf.Bytes()
+	}
+	if h.head != "" && !strings.HasSuffix(h.head, "\n") {
+		buf.WriteString("\n")
+	}
+	buf.WriteString(beginMarker + "\n")
+	buf.Write(r.Render(h.managed))
+	buf.WriteString(endMarker + "\n")
+	buf.WriteString(h.tail)
+	return buf.Bytes()
+}
@@ -0,0 +1,60 @@
+package updater
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHostsRoundTrip(t *testing.T) {
+	files := []string{
+		"",
+		"127.0.0.1 localhost\n",
+		"127.0.0.1 localhost",
+		"# comment only\n\n\n",
+		"127.0.0.1\tlocalhost\r\n::1 ip6-localhost\r\n",
+		"10.0.0.1 a\n" + beginMarker + "\n10.0.0.2    b\n" + endMarker + "\n10.0.0.3 c\n",
+		beginMarker + "\n10.0.0.2    b c\n" + endMarker + "\n",
+	}
+	for _, file := range files {
+		if out := string(ParseHosts([]byte(file)).Bytes()); out != file {
+			t.Fatalf("Round trip of %q produced %q", file, out)
+		}
+	}
+}
+
+func TestParseHostsManagedBlock(t *testing.T) {
+	h := ParseHosts([]byte("10.0.0.1 a\n  " + beginMarker + "  \n10.0.0.2 b c # x\n\n# note\n" + endMarker + "\n10.0.0.3 d\n"))
+	expected := []Entry{{IP: "10.0.0.2", Names: []string{"b", "c"}}}
+	if !reflect.DeepEqual(h.Managed(), expected) {
+		t.Fatalf("Expected managed entries %v, found %v", expected, h.Managed())
+	}
+	if len(h.Entries()) != 3 {
+		t.Fatalf("Expected 3 entries, found %d", len(h.Entries()))
+	}
+
+	h.SetManaged([]Entry{{IP: "10.0.0.9", Names: []string{"z"}}})
+	out := "10.0.0.1 a\n" + beginMarker + "\n10.0.0.9    z\n" + endMarker + "\n10.0.0.3 d\n"
+	if string(h.Bytes()) != out {
+		t.Fatalf("Expected %q, found %q", out, string(h.Bytes()))
+	}
+}
+
+func TestParseHostsUnterminatedBlock(t *testing.T) {
+	h := ParseHosts([]byte("10.0.0.1 a\n" + beginMarker + "\n10.0.0.2 b\n10.0.0.3"))
+	if len(h.Managed()) != 1 {
+		t.Fatalf("Expected 1 managed entry, found %d", len(h.Managed()))
+	}
+	out := "10.0.0.1 a\n" + beginMarker + "\n10.0.0.2    b\n" + endMarker + "\n"
+	if string(h.Bytes()) != out {
+		t.Fatalf("Expected %q, found %q", out, string(h.Bytes()))
+	}
+}
+
+func TestSetManagedAppendsBlock(t *testing.T) {
+	h := ParseHosts([]byte("127.0.0.1 localhost"))
+	h.SetManaged([]Entry{{IP: "10.0.0.1", Names: []string{"a"}}})
+	out := "127.0.0.1 localhost\n" + beginMarker + "\n10.0.0.1    a\n" + endMarker + "\n"
+	if string(h.Bytes()) != out {
+		t.Fatalf("Expected %q, found %q", out, string(h.Bytes()))
+	}
+}
@@ -0,0 +1,109 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// NameTemplates render the names published for each kind of metadata
+// object. Every template may render several names separated by spaces or
+// commas. Sources without templates publish their default name.
+type NameTemplates struct {
+	Host      []*template.Template
+	Container []*template.Template
+	Service   []*template.Template
+}
+
+// ParseNameTemplates parses the templates for one source and executes them
+// against an empty object, so references to fields the object does not
+// have fail at startup instead of on every update.
+func ParseNameTemplates(source Source, texts []string) ([]*template.Template, error) {
+	var zero interface{}
+	switch source {
+	case SourceHosts:
+		zero = metadata.Host{}
+	case SourceContainers:
+		zero = metadata.Container{}
+	case SourceServices:
+		zero = metadata.Service{}
+	default:
+		return nil, fmt.Errorf("Unknown source %q", source)
+	}
+
+	templates := []*template.Template{}
+	for _, text := range texts {
+		tmpl, err := template.New(string(source)).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s name template %q: %v", source, text, err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, zero); err != nil {
+			return nil, fmt.Errorf("Invalid %s name template %q: %v", source, text, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+// renderNames returns the valid, distinct names for obj. defaultName is
+// used when there are no templates.
+func renderNames(templates []*template.Template, obj interface{}, defaultName string) []string {
+	rendered := []string{defaultName}
+	if len(templates) > 0 {
+		rendered = nil
+		for _, tmpl := range templates {
+			buf := &bytes.Buffer{}
+			if err := tmpl.Execute(buf, obj); err != nil {
+				log.Errorf("Error rendering name template for %s: %v", defaultName, err)
+				continue
+			}
+			rendered = append(rendered, strings.FieldsFunc(buf.String(), func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\n'
+			})...)
+		}
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range rendered {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if !validHostname(name) {
+			log.Warnf("Skipping invalid hostname %q for %s", name, defaultName)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// validHostname checks name against RFC 1123: dot separated labels of
+// letters, digits and hyphens, each 1 to 63 characters long and not
+// starting or ending with a hyphen, at most 253 characters in total.
+func validHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package updater
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestParseNameTemplatesRejectsInvalid(t *testing.T) {
+	invalid := []struct {
+		source Source
+		text   string
+	}{
+		{SourceHosts, "{{.Hostname"},
+		{SourceHosts, "{{.PrimaryIp}}"},
+		{SourceContainers, "{{.Hostname}}"},
+		{SourceServices, "{{.AgentIP}}"},
+	}
+	for _, c := range invalid {
+		if _, err := ParseNameTemplates(c.source, []string{c.text}); err == nil {
+			t.Fatalf("Expected %s template %q to be rejected", c.source, c.text)
+		}
+	}
+
+	if _, err := ParseNameTemplates(SourceHosts, []string{"{{.Hostname}}.{{.Labels.zone}}.internal"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestRenderNames(t *testing.T) {
+	templates, err := ParseNameTemplates(SourceHosts, []string{
+		"{{.Hostname}}.{{.Labels.zone}}.internal",
+		"{{.Hostname}} {{.Name}}",
+		"{{.Labels.alias}}",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	host := metadata.Host{
+		Name:     "node_1",
+		Hostname: "node1",
+		Labels: map[string]string{
+			"zone": "east",
+		},
+	}
+	names := renderNames(templates, host, host.Hostname)
+	expected := []string{"node1.east.internal", "node1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, found %v", expected, names)
+	}
+
+	host.Labels = nil
+	names = renderNames(templates, host, host.Hostname)
+	expected = []string{"node1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected names with missing labels to be dropped, found %v", names)
+	}
+
+	if names := renderNames(nil, host, "node1"); !reflect.DeepEqual(names, []string{"node1"}) {
+		t.Fatalf("Expected default name without templates, found %v", names)
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	valid := []string{"a", "node-1", "Node1.example.com", "1.2.3", "x23456789012345678901234567890123456789012345678901234567890123"}
+	invalid := []string{"", "-a", "a-", "a..b", ".a", "a_b", "a b", "x234567890123456789012345678901234567890123456789012345678901234"}
+	for _, name := range valid {
+		if !validHostname(name) {
+			t.Fatalf("Expected %q to be valid", name)
+		}
+	}
+	for _, name := range invalid {
+		if validHostname(name) {
+			t.Fatalf("Expected %q to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Renderer formats the entries of the rancher-managed block. Everything
+// outside the block is kept as it is, so a format must treat lines
+// starting with # as comments.
+type Renderer interface {
+	// Render returns the lines of the block, each ending in a newline
+	Render(entries []Entry) []byte
+}
+
+// Renderers are the output formats by name
+var Renderers = map[string]Renderer{
+	"hosts": HostsRenderer{},
+	// The CoreDNS hosts plugin reads the hosts file syntax
+	"coredns":         HostsRenderer{},
+	"dnsmasq":         DnsmasqRenderer{},
+	"dnsmasq-address": DnsmasqAddressRenderer{},
+	"unbound":         UnboundRenderer{},
+}
+
+// ParseFormat returns the renderer of a format given on the command line
+func ParseFormat(s string) (Renderer, error) {
+	if r, ok := Renderers[s]; ok {
+		return r, nil
+	}
+	formats := []string{}
+	for format := range Renderers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return nil, fmt.Errorf("Invalid format %q, expected one of %s", s, strings.Join(formats, ", "))
+}
+
+// HostsRenderer writes /etc/hosts lines
+type HostsRenderer struct{}
+
+func (HostsRenderer) Render(entries []Entry) []byte {
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		buf.WriteString(entry.String() + "\n")
+	}
+	return buf.Bytes()
+}
+
+// DnsmasqRenderer writes dnsmasq host-record options, which answer for the
+// names and their reverse lookups
+type DnsmasqRenderer struct{}
+
+func (DnsmasqRenderer) Render(entries []Entry) []byte {
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		fmt.Fprintf(buf, "host-record=%s,%s\n", strings.Join(entry.Names, ","), entry.IP)
+	}
+	return buf.Bytes()
+}
+
+// DnsmasqAddressRenderer writes dnsmasq address options, which answer for
+// the names and every name below them
+type DnsmasqAddressRenderer struct{}
+
+func (DnsmasqAddressRenderer) Render(entries []Entry) []byte {
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		fmt.Fprintf(buf, "address=/%s/%s\n", strings.Join(entry.Names, "/"), entry.IP)
+	}
+	return buf.Bytes()
+}
+
+// UnboundRenderer writes unbound local-data records for the server clause,
+// with a reverse record for the first name of each address
+type UnboundRenderer struct{}
+
+func (UnboundRenderer) Render(entries []Entry) []byte {
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		recordType := "A"
+		if strings.Contains(entry.IP, ":") {
+			recordType = "AAAA"
+		}
+		for _, name := range entry.Names {
+			fmt.Fprintf(buf, "local-data: \"%s. %s %s\"\n", name, recordType, entry.IP)
+		}
+		fmt.Fprintf(buf, "local-data-ptr: \"%s %s.\"\n", entry.IP, entry.Names[0])
+	}
+	return buf.Bytes()
+}
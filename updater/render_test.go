@@ -0,0 +1,54 @@
+package updater
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var renderEntries = []Entry{
+	{IP: "10.0.0.1", Names: []string{"alpha", "alpha.rancher.internal"}},
+	{IP: "fd00::1", Names: []string{"alpha", "alpha.rancher.internal"}},
+	{IP: "10.0.0.2", Names: []string{"web.stack"}},
+}
+
+func TestRenderersGolden(t *testing.T) {
+	for format, renderer := range Renderers {
+		h := ParseHosts([]byte("# kept as it is\n"))
+		h.SetManaged(renderEntries)
+
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", "render-"+format+".golden"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if rendered := h.Render(renderer); string(rendered) != string(golden) {
+			t.Fatalf("Expected %s output\n%s\nfound\n%s", format, golden, rendered)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if r, err := ParseFormat("unbound"); err != nil || r != (UnboundRenderer{}) {
+		t.Fatalf("Expected the unbound renderer, got %v %v", r, err)
+	}
+	if _, err := ParseFormat("bind"); err == nil {
+		t.Fatalf("Expected an error for an unknown format")
+	}
+}
+
+func TestUpdateRendersFormat(t *testing.T) {
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: client,
+		Writer:         w,
+		Renderer:       DnsmasqRenderer{},
+		self:           []Entry{},
+	}
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := beginMarker + "\nhost-record=Host1,10.1.0.1\n" + endMarker + "\n"
+	if string(w.data) != expected {
+		t.Fatalf("Expected %q, found %q", expected, string(w.data))
+	}
+}
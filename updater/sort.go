@@ -0,0 +1,90 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// SortOrder decides the order of the entries in the rancher-managed block
+type SortOrder string
+
+const (
+	SortByHostname SortOrder = "hostname"
+	SortByIP       SortOrder = "ip"
+	SortByHostID   SortOrder = "host-id"
+)
+
+// ParseSortOrder validates a sort order given on the command line
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch order := SortOrder(s); order {
+	case SortByHostname, SortByIP, SortByHostID:
+		return order, nil
+	}
+	return "", fmt.Errorf("Invalid sort order %q, expected one of %s, %s or %s", s, SortByHostname, SortByIP, SortByHostID)
+}
+
+type recordSorter struct {
+	records []Record
+	less    func(a, b Record) bool
+}
+
+func (s recordSorter) Len() int           { return len(s.records) }
+func (s recordSorter) Swap(i, j int)      { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s recordSorter) Less(i, j int) bool { return s.less(s.records[i], s.records[j]) }
+
+// sortRecords orders records in place. Ties are broken by the first name so
+// the output never depends on the order metadata returned the objects in.
+func sortRecords(records []Record, order SortOrder) {
+	less := func(a, b Record) bool {
+		return a.Names[0] < b.Names[0]
+	}
+	switch order {
+	case SortByIP:
+		less = func(a, b Record) bool {
+			if c := compareIPs(a.IPs[0], b.IPs[0]); c != 0 {
+				return c < 0
+			}
+			return a.Names[0] < b.Names[0]
+		}
+	case SortByHostID:
+		less = func(a, b Record) bool {
+			if a.ID != b.ID {
+				return a.ID < b.ID
+			}
+			return a.Names[0] < b.Names[0]
+		}
+	}
+	sort.Sort(recordSorter{records, less})
+}
+
+// compareIPs orders addresses numerically, IPv4 before IPv6. Strings that
+// do not parse as an address go last, in lexical order.
+func compareIPs(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case ipA == nil && ipB == nil:
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case ipA == nil:
+		return 1
+	case ipB == nil:
+		return -1
+	}
+
+	v4A, v4B := ipA.To4(), ipB.To4()
+	switch {
+	case v4A != nil && v4B != nil:
+		return bytes.Compare(v4A, v4B)
+	case v4A != nil:
+		return -1
+	case v4B != nil:
+		return 1
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
+}
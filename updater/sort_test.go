@@ -0,0 +1,91 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+var unsortedHosts = []metadata.Host{
+	{Hostname: "charlie", AgentIP: "10.0.0.10", HostId: 2},
+	{Hostname: "alpha", AgentIP: "fd00::1", HostId: 3},
+	{Hostname: "bravo", AgentIP: "10.0.0.9", HostId: 1},
+	{Hostname: "delta", AgentIP: "192.168.1.1", HostId: 4},
+}
+
+func TestSortOrderGolden(t *testing.T) {
+	for _, order := range []SortOrder{SortByHostname, SortByIP, SortByHostID} {
+		w := &memWriter{data: []byte("127.0.0.1 localhost\n")}
+		u := &Updater{
+			MetadataClient: &fakeMetadataClient{hosts: unsortedHosts},
+			SortOrder:      order,
+			Writer:         w,
+			self: []Entry{{
+				IP:    "10.0.0.2",
+				Names: []string{"self"},
+			}},
+		}
+		if err := u.Sync(); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", "sort-"+string(order)+".golden"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if string(w.data) != string(golden) {
+			t.Fatalf("Expected %s order\n%s\nfound\n%s", order, golden, w.data)
+		}
+	}
+}
+
+func TestUpdateSkipsIdenticalWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sort")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{hosts: unsortedHosts},
+		Writer:         FileWriter{path},
+		self: []Entry{{
+			IP:    "10.0.0.2",
+			Names: []string{"self"},
+		}},
+	}
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// A fresh map forces Update to render again, as after a restart
+	if err := u.Update(map[string]string{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !info.ModTime().Equal(past) {
+		t.Fatalf("Expected identical content not to be written again")
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	if order, err := ParseSortOrder("ip"); err != nil || order != SortByIP {
+		t.Fatalf("Expected ip to parse, got %q %v", order, err)
+	}
+	if _, err := ParseSortOrder("random"); err == nil {
+		t.Fatalf("Expected invalid sort order to be rejected")
+	}
+}
@@ -0,0 +1,161 @@
+package updater
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/selector"
+)
+
+// Source is a kind of metadata object published in the hosts file
+type Source string
+
+const (
+	SourceHosts      Source = "hosts"
+	SourceContainers Source = "containers"
+	SourceServices   Source = "services"
+)
+
+// Selectors limit the published objects of each source by their labels
+type Selectors struct {
+	Host      selector.Selector
+	Container selector.Selector
+	Service   selector.Selector
+}
+
+// Record is a single name to address mapping produced by a source
+type Record struct {
+	Names []string
+	// IPs are valid, canonical addresses, IPv4 first
+	IPs []string
+	// ID is the HostId of a host and the CreateIndex of a container or
+	// service, used by the host-id sort order and the duplicate policies
+	ID   int
+	UUID string
+}
+
+// records fetches the records of every enabled source, in source order.
+// Only hosts are published when no sources were configured.
+func (u *Updater) records() ([]Record, error) {
+	sources := u.Sources
+	if sources == nil {
+		sources = []Source{SourceHosts}
+	}
+
+	var records []Record
+	for _, source := range sources {
+		var (
+			sourceRecords []Record
+			err           error
+		)
+		switch source {
+		case SourceHosts:
+			sourceRecords, err = u.hostRecords()
+		case SourceContainers:
+			sourceRecords, err = u.containerRecords()
+		case SourceServices:
+			sourceRecords, err = u.serviceRecords()
+		default:
+			err = fmt.Errorf("Unknown source %q", source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, sourceRecords...)
+	}
+	return records, nil
+}
+
+func (u *Updater) hostRecords() ([]Record, error) {
+	hosts, err := u.MetadataClient.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, host := range hosts {
+		if !u.Selectors.Host.Matches(host.Labels) {
+			log.Debugf("Skipping host %s not matching selector %s", host.Hostname, u.Selectors.Host)
+			continue
+		}
+		ips := u.addresses(host.Hostname, []string{host.AgentIP}, host.Labels)
+		if len(ips) == 0 {
+			log.Debugf("Skipping host %s without addresses", host.Hostname)
+			continue
+		}
+		records = append(records, Record{
+			Names: renderNames(u.NameTemplates.Host, host, host.Hostname),
+			IPs:   ips,
+			ID:    host.HostId,
+			UUID:  host.UUID,
+		})
+	}
+	return records, nil
+}
+
+func (u *Updater) containerRecords() ([]Record, error) {
+	containers, err := u.MetadataClient.GetContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, container := range containers {
+		if !u.Selectors.Container.Matches(container.Labels) {
+			log.Debugf("Skipping container %s not matching selector %s", container.Name, u.Selectors.Container)
+			continue
+		}
+		ips := container.Ips
+		if len(ips) == 0 && container.PrimaryIp != "" {
+			ips = []string{container.PrimaryIp}
+		}
+		ips = u.addresses(container.Name, ips, container.Labels)
+		if len(ips) == 0 {
+			log.Debugf("Skipping container %s without addresses", container.Name)
+			continue
+		}
+		records = append(records, Record{
+			Names: renderNames(u.NameTemplates.Container, container, container.Name),
+			IPs:   ips,
+			ID:    container.CreateIndex,
+			UUID:  container.UUID,
+		})
+	}
+	return records, nil
+}
+
+func (u *Updater) serviceRecords() ([]Record, error) {
+	services, err := u.MetadataClient.GetServices()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, service := range services {
+		if !u.Selectors.Service.Matches(service.Labels) {
+			log.Debugf("Skipping service %s.%s not matching selector %s", service.Name, service.StackName, u.Selectors.Service)
+			continue
+		}
+		name := service.Name
+		if service.StackName != "" {
+			name = name + "." + service.StackName
+		}
+		// External services have no VIP but point at external IPs
+		ips := service.ExternalIps
+		if service.Vip != "" {
+			ips = []string{service.Vip}
+		}
+		ips = u.addresses(name, ips, service.Labels)
+		if len(ips) == 0 {
+			log.Debugf("Skipping service %s without addresses", name)
+			continue
+		}
+		records = append(records, Record{
+			Names: renderNames(u.NameTemplates.Service, service, name),
+			IPs:   ips,
+			ID:    service.CreateIndex,
+			UUID:  service.UUID,
+		})
+	}
+	return records, nil
+}
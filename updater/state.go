@@ -0,0 +1,140 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// stateSaveInterval is how often a state only confirmed again by metadata
+// is saved, changed states are saved right away
+const stateSaveInterval = time.Minute
+
+// State is what an updater last applied from metadata. It is saved so that
+// a restart while metadata is down can apply it again.
+type State struct {
+	// Version is the metadata version of the last update
+	Version string `json:"version"`
+	// Updated is when metadata last confirmed the entries
+	Updated time.Time `json:"updated"`
+	// Hosts maps every published name to its addresses
+	Hosts map[string]string `json:"hosts"`
+	// Entries is the content of the rancher-managed block
+	Entries []Entry `json:"entries"`
+}
+
+// State returns the state of the last successful update, false before the
+// first
+func (u *Updater) State() (State, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	if u.status.lastUpdate.IsZero() || u.status.applied == nil {
+		return State{}, false
+	}
+	return State{
+		Version: u.status.version,
+		Updated: u.status.lastUpdate,
+		Hosts:   u.status.appliedHosts,
+		Entries: u.status.applied,
+	}, true
+}
+
+// ApplyState writes the entries of s without reading metadata, for a start
+// while metadata is down. The next update reconciles them with metadata;
+// until then the updater is not ready.
+func (u *Updater) ApplyState(s State) error {
+	if err := u.read(); err != nil {
+		u.setStatus(func(s *status) { s.lastError, s.writeErr = err, err })
+		return err
+	}
+
+	changes := compareHosts(u.rancherHosts, s.Hosts)
+	u.lock.Lock()
+	u.rancherHosts = make(map[string]string, len(s.Hosts))
+	for name, ips := range s.Hosts {
+		u.rancherHosts[name] = ips
+	}
+	u.lock.Unlock()
+
+	u.hostsFile.SetManaged(s.Entries)
+	return u.write(changes)
+}
+
+// StateFile keeps the states of the targets of a Group on disk, by target
+type StateFile struct {
+	Path string
+	// MaxAge is the age after which a state is too stale to be applied,
+	// 0 applies states of any age
+	MaxAge time.Duration
+
+	saved     map[string]State
+	savedTime time.Time
+}
+
+type stateFileContent struct {
+	Targets map[string]State `json:"targets"`
+}
+
+// Load returns the states in the file that are recent enough at now. A
+// missing file has none.
+func (f *StateFile) Load(now time.Time) (map[string]State, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return map[string]State{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading state %s: %v", f.Path, err)
+	}
+	content := stateFileContent{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("Error parsing state %s: %v", f.Path, err)
+	}
+
+	states := map[string]State{}
+	for target, state := range content.Targets {
+		if age := now.Sub(state.Updated); f.MaxAge > 0 && age > f.MaxAge {
+			log.Warnf("Not applying the state of %s from %s, it is older than %v", target, state.Updated.Format(time.RFC3339), f.MaxAge)
+			continue
+		}
+		states[target] = state
+	}
+	return states, nil
+}
+
+// Save writes states to the file. States that changed only by being
+// confirmed again are written at most every stateSaveInterval.
+func (f *StateFile) Save(states map[string]State, now time.Time) error {
+	if len(states) == 0 || now.Sub(f.savedTime) < stateSaveInterval && sameStates(states, f.saved) {
+		return nil
+	}
+	data, err := json.MarshalIndent(stateFileContent{Targets: states}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(f.Path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing state %s: %v", f.Path, err)
+	}
+	f.saved = states
+	f.savedTime = now
+	return nil
+}
+
+// sameStates reports whether a and b hold the same entries, whenever they
+// were confirmed
+func sameStates(a, b map[string]State) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for target, state := range a {
+		other, ok := b[target]
+		if !ok || !reflect.DeepEqual(state.Hosts, other.Hosts) || !reflect.DeepEqual(state.Entries, other.Entries) {
+			return false
+		}
+	}
+	return true
+}
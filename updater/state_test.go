@@ -0,0 +1,145 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestApplyStateThenReconcile(t *testing.T) {
+	client := &fakeMetadataClient{
+		hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+	}
+	first := &Updater{MetadataClient: client, Writer: &memWriter{}, self: []Entry{}}
+	if _, ok := first.State(); ok {
+		t.Fatalf("Expected no state before the first update")
+	}
+	first.Run("1")
+	state, ok := first.State()
+	if !ok || state.Version != "1" || state.Hosts["Host1"] != "10.1.0.1" || len(state.Entries) != 1 {
+		t.Fatalf("Expected the state of the update, got %+v", state)
+	}
+
+	// Started again while metadata is down
+	w := &memWriter{data: []byte("127.0.0.1    localhost\n")}
+	changes := []Change{}
+	u := &Updater{
+		Writer:   w,
+		self:     []Entry{},
+		OnChange: func(c Change) { changes = append(changes, c) },
+	}
+	if err := u.ApplyState(state); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := "127.0.0.1    localhost\n" + beginMarker + "\n10.1.0.1    Host1\n" + endMarker + "\n"
+	if string(w.data) != expected {
+		t.Fatalf("Expected hosts file\n%q\nfound\n%q", expected, string(w.data))
+	}
+	if status := u.Status(); status.Ready || status.Entries["Host1"] != "10.1.0.1" {
+		t.Fatalf("Expected the cached entries and not to be ready, got %+v", status)
+	}
+	if _, ok := u.State(); ok {
+		t.Fatalf("Expected no state to save before metadata confirmed it")
+	}
+
+	// Metadata is back with another host
+	u.MetadataClient = &fakeMetadataClient{
+		hosts: []metadata.Host{{Hostname: "Host2", AgentIP: "10.1.0.2"}},
+	}
+	u.Run("2")
+	expected = "127.0.0.1    localhost\n" + beginMarker + "\n10.1.0.2    Host2\n" + endMarker + "\n"
+	if string(w.data) != expected {
+		t.Fatalf("Expected hosts file\n%q\nfound\n%q", expected, string(w.data))
+	}
+	expectedChanges := []Change{
+		{Added: []string{"Host1"}},
+		{Added: []string{"Host2"}, Removed: []string{"Host1"}},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) || !u.Status().Ready {
+		t.Fatalf("Expected changes %v, found %v", expectedChanges, changes)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1451703845, 0).UTC()
+	f := &StateFile{Path: filepath.Join(dir, "state.json"), MaxAge: time.Hour}
+	if states, err := f.Load(now); err != nil || len(states) != 0 {
+		t.Fatalf("Expected no states without a file, got %v %v", states, err)
+	}
+
+	states := map[string]State{
+		"/etc/hosts": {
+			Version: "7",
+			Updated: now,
+			Hosts:   map[string]string{"Host1": "10.1.0.1"},
+			Entries: []Entry{{IP: "10.1.0.1", Names: []string{"Host1"}}},
+		},
+		"/etc/dnsmasq.d/rancher.conf": {
+			Version: "7",
+			Updated: now.Add(-2 * time.Hour),
+			Hosts:   map[string]string{},
+			Entries: []Entry{},
+		},
+	}
+	if err := f.Save(states, now); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	loaded, err := (&StateFile{Path: f.Path, MaxAge: time.Hour}).Load(now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(loaded) != 1 || !reflect.DeepEqual(loaded["/etc/hosts"], states["/etc/hosts"]) {
+		t.Fatalf("Expected only the recent state, got %+v", loaded)
+	}
+	if all, _ := (&StateFile{Path: f.Path}).Load(now.Add(time.Minute)); len(all) != 2 {
+		t.Fatalf("Expected states of any age without a maximum, got %+v", all)
+	}
+
+	// Only confirmed again, written once the interval passed
+	g := &StateFile{Path: filepath.Join(dir, "confirmed.json")}
+	state := states["/etc/hosts"]
+	if err := g.Save(map[string]State{"/etc/hosts": state}, now); err != nil {
+		t.Fatalf("%v", err)
+	}
+	state.Version, state.Updated = "8", now.Add(time.Second)
+	if err := g.Save(map[string]State{"/etc/hosts": state}, now.Add(time.Second)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if loaded, _ := g.Load(now); loaded["/etc/hosts"].Version != "7" {
+		t.Fatalf("Expected the confirmed state not to be written yet, got %+v", loaded)
+	}
+	if err := g.Save(map[string]State{"/etc/hosts": state}, now.Add(stateSaveInterval)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if loaded, _ := g.Load(now); loaded["/etc/hosts"].Version != "8" {
+		t.Fatalf("Expected the confirmed state to be written after the interval, got %+v", loaded)
+	}
+}
+
+func TestStateFileInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := (&StateFile{Path: path}).Load(time.Now()); err == nil {
+		t.Fatalf("Expected an error for an invalid state file")
+	}
+}
@@ -0,0 +1,149 @@
+package updater
+
+import (
+	"time"
+)
+
+// Status is a snapshot of what the updater last saw and did
+type Status struct {
+	// Target is the output of the updater, set by Group
+	Target string `json:"target"`
+	// Entries maps every published name to its comma separated addresses
+	Entries    map[string]string `json:"entries"`
+	Duplicates []Duplicate       `json:"duplicates"`
+	// Version is the last metadata version an update ran for
+	Version string `json:"version"`
+	// LastUpdate is when the last update succeeded, zero before the first
+	LastUpdate time.Time `json:"lastUpdate"`
+	LastError  string    `json:"lastError,omitempty"`
+	// MetadataReachable and WriteSucceeded report the last metadata read
+	// and hosts file write, they are true until one was tried
+	MetadataReachable bool `json:"metadataReachable"`
+	WriteSucceeded    bool `json:"writeSucceeded"`
+	// Ready is set by the first successful update
+	Ready bool `json:"ready"`
+	// Holding is set while the removal guard holds back an update
+	Holding bool `json:"holding"`
+}
+
+// Metrics are the counters and gauges of the updater since it started
+type Metrics struct {
+	// Target is the output of the updater, set by Group
+	Target string
+	// Cycles counts the calls of Run
+	Cycles         uint64
+	Writes         uint64
+	WriteFailures  uint64
+	MetadataErrors uint64
+	HostsAdded     uint64
+	HostsChanged   uint64
+	HostsRemoved   uint64
+	// Repairs counts the changes of the rancher-managed block by other
+	// programs that were noticed
+	Repairs uint64
+	// Holds counts the updates held back by the removal guard
+	Holds uint64
+	// Entries is the number of published names
+	Entries     int
+	LastSuccess time.Time
+	// VersionChanged is when Run was first called with the current
+	// metadata version
+	VersionChanged time.Time
+}
+
+// status is the state behind Status and Metrics, guarded by Updater.lock
+type status struct {
+	version        string
+	versionChanged time.Time
+	lastUpdate     time.Time
+	lastError      error
+	metadataErr    error
+	writeErr       error
+
+	cycles         uint64
+	writes         uint64
+	writeFailures  uint64
+	metadataErrors uint64
+	hostsAdded     uint64
+	hostsChanged   uint64
+	hostsRemoved   uint64
+	repairs        uint64
+	holds          uint64
+	// holding is set while the removal guard holds back an update
+	holding bool
+
+	// applied and appliedHosts are the managed entries and names of the
+	// last successful write
+	applied      []Entry
+	appliedHosts map[string]string
+}
+
+// Status returns a copy of the current status. It is safe to call while
+// an update runs.
+func (u *Updater) Status() Status {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	entries := make(map[string]string, len(u.rancherHosts))
+	for name, ips := range u.rancherHosts {
+		entries[name] = ips
+	}
+	s := Status{
+		Entries:           entries,
+		Duplicates:        append([]Duplicate{}, u.duplicates...),
+		Version:           u.status.version,
+		LastUpdate:        u.status.lastUpdate,
+		MetadataReachable: u.status.metadataErr == nil,
+		WriteSucceeded:    u.status.writeErr == nil,
+		Ready:             !u.status.lastUpdate.IsZero(),
+		Holding:           u.status.holding,
+	}
+	if u.status.lastError != nil {
+		s.LastError = u.status.lastError.Error()
+	}
+	return s
+}
+
+// Metrics returns a copy of the current metrics
+func (u *Updater) Metrics() Metrics {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return Metrics{
+		Cycles:         u.status.cycles,
+		Writes:         u.status.writes,
+		WriteFailures:  u.status.writeFailures,
+		MetadataErrors: u.status.metadataErrors,
+		HostsAdded:     u.status.hostsAdded,
+		HostsChanged:   u.status.hostsChanged,
+		HostsRemoved:   u.status.hostsRemoved,
+		Repairs:        u.status.repairs,
+		Holds:          u.status.holds,
+		Entries:        len(u.rancherHosts),
+		LastSuccess:    u.status.lastUpdate,
+		VersionChanged: u.status.versionChanged,
+	}
+}
+
+// MetadataError records an error reading metadata outside of an update,
+// such as failing to watch for changes
+func (u *Updater) MetadataError(err error) {
+	u.setStatus(func(s *status) {
+		s.metadataErr = err
+		s.lastError = err
+		s.metadataErrors++
+	})
+}
+
+// MetadataReached records reading metadata outside of an update, such as
+// watching for changes, clearing the error of an earlier read
+func (u *Updater) MetadataReached() {
+	u.setStatus(func(s *status) { s.metadataErr = nil })
+}
+
+// setStatus records a change of the status under the lock
+func (u *Updater) setStatus(change func(s *status)) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	change(&u.status)
+}
@@ -0,0 +1,125 @@
+package updater
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// failingWriter fails every write while fail is set
+type failingWriter struct {
+	memWriter
+	fail bool
+}
+
+func (f *failingWriter) Write(data []byte) (bool, error) {
+	if f.fail {
+		return false, fmt.Errorf("disk full")
+	}
+	return f.memWriter.Write(data)
+}
+
+func TestStatusTracksUpdates(t *testing.T) {
+	w := &failingWriter{fail: true}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+		},
+		Writer: w,
+		self:   []Entry{},
+	}
+
+	status := u.Status()
+	if status.Ready || !status.MetadataReachable || !status.WriteSucceeded {
+		t.Fatalf("Expected a fresh updater to be healthy and not ready, got %+v", status)
+	}
+
+	u.Run("1")
+	status = u.Status()
+	if status.Ready || status.WriteSucceeded || status.LastError != "disk full" || status.Version != "1" {
+		t.Fatalf("Expected the failed write to be reported, got %+v", status)
+	}
+
+	// The names did not change, the failed write must be retried anyway
+	w.fail = false
+	u.Run("2")
+	status = u.Status()
+	if !status.Ready || !status.WriteSucceeded || w.writes != 1 {
+		t.Fatalf("Expected the write to be retried, got %+v after %d writes", status, w.writes)
+	}
+	if status.Entries["Host1"] != "10.1.0.1" || status.Version != "2" {
+		t.Fatalf("Expected Host1 in the entries, got %+v", status)
+	}
+}
+
+func TestStatusWhileUpdating(t *testing.T) {
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{Hostname: "Host1", AgentIP: "10.1.0.1"},
+				{Hostname: "Host1", AgentIP: "10.1.0.2"},
+			},
+		},
+		Writer: &memWriter{},
+		self:   []Entry{},
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			u.Status()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		u.dirty = true
+		u.Run(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	if status := u.Status(); len(status.Entries) != 1 || len(status.Duplicates) != 1 {
+		t.Fatalf("Expected one entry and one duplicate, got %+v", status)
+	}
+}
+
+func TestMetricsCountUpdates(t *testing.T) {
+	client := &fakeMetadataClient{
+		hosts: []metadata.Host{
+			{Hostname: "Host1", AgentIP: "10.1.0.1"},
+			{Hostname: "Host2", AgentIP: "10.1.0.2"},
+		},
+	}
+	u := &Updater{
+		MetadataClient: client,
+		Writer:         &memWriter{},
+		self:           []Entry{},
+	}
+
+	u.Run("1")
+	client.hosts = []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.3"}}
+	u.Run("2")
+	u.Run("2")
+
+	m := u.Metrics()
+	if m.Cycles != 3 || m.Writes != 2 || m.WriteFailures != 0 || m.MetadataErrors != 0 {
+		t.Fatalf("Expected 3 cycles and 2 writes, got %+v", m)
+	}
+	if m.HostsAdded != 2 || m.HostsChanged != 1 || m.HostsRemoved != 1 || m.Entries != 1 {
+		t.Fatalf("Expected the changes to be counted, got %+v", m)
+	}
+	if m.LastSuccess.IsZero() || m.VersionChanged.IsZero() {
+		t.Fatalf("Expected the times to be set, got %+v", m)
+	}
+
+	u.MetadataError(fmt.Errorf("connection refused"))
+	if m := u.Metrics(); m.MetadataErrors != 1 || u.Status().MetadataReachable {
+		t.Fatalf("Expected the metadata error to be recorded, got %+v", m)
+	}
+	u.MetadataReached()
+	if m := u.Metrics(); m.MetadataErrors != 1 || !u.Status().MetadataReachable {
+		t.Fatalf("Expected the metadata error to be cleared, got %+v", m)
+	}
+}
@@ -1,10 +1,14 @@
 package updater
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
@@ -12,98 +16,316 @@ import (
 
 var (
 	hostsOrigFile = "/etc/hosts"
+	// hostname and lookupIP are swapped out in tests
+	hostname = os.Hostname
+	lookupIP = net.LookupIP
 )
 
 // MetadataClient - This abstraction allows this to be mocked easily in tests
 type MetadataClient interface {
+	GetSelfContainer() (metadata.Container, error)
+	GetSelfHost() (metadata.Host, error)
 	GetHosts() ([]metadata.Host, error)
+	GetContainers() ([]metadata.Container, error)
+	GetServices() ([]metadata.Service, error)
 }
 
 type Updater struct {
 	MetadataClient MetadataClient
-	rancherHosts   map[string]string
-	origData       string
+	SortOrder      SortOrder
+	Sources        []Source
+	NameTemplates  NameTemplates
+	Selectors      Selectors
+	Guard          RemovalGuard
+	// DuplicatePolicy defaults to DuplicateFirst
+	DuplicatePolicy DuplicatePolicy
+	// AddressFamily defaults to publishing both IPv4 and IPv6 addresses
+	AddressFamily AddressFamily
+	// AddressLabels name labels listing extra addresses of an object
+	AddressLabels []string
+	// Writer defaults to writing /etc/hosts
+	Writer Writer
+	// Renderer defaults to the hosts file format
+	Renderer Renderer
+	// OnChange, if set, is called after an update wrote new content
+	OnChange func(Change)
+
+	rancherHosts map[string]string
+	hostsFile    *HostsFile
+	original     []byte
+	// current is the content of the output as last read or written, a
+	// difference on disk means another program changed it
+	current    []byte
+	self       []Entry
+	duplicates []Duplicate
+	// dirty forces the next Update to write even if no name changed
+	dirty bool
+	// wroteBlock is set once this process wrote the rancher-managed
+	// block, until then the block on disk is not ours to repair
+	wroteBlock bool
+
+	// lock guards rancherHosts, duplicates and status for Status, which
+	// may be called while an update runs
+	lock   sync.RWMutex
+	status status
+}
+
+func (u *Updater) Run(version string) {
+	u.setStatus(func(s *status) {
+		s.cycles++
+		if version != s.version {
+			s.version = version
+			s.versionChanged = time.Now()
+		}
+	})
+	if err := u.Sync(); err != nil {
+		log.Errorf("Error updating %s: [%v]", u.writer(), err)
+	}
+}
+
+// Sync updates the hosts file from metadata once
+func (u *Updater) Sync() error {
+	if err := u.init(); err != nil {
+		u.setStatus(func(s *status) { s.lastError, s.writeErr = err, err })
+		return err
+	}
+	return u.Update(u.rancherHosts)
+}
+
+// Render returns the hosts file as Update would write it, without writing
+// anything.
+func (u *Updater) Render() ([]byte, error) {
+	if err := u.init(); err != nil {
+		return nil, err
+	}
+	records, err := u.records()
+	if err != nil {
+		return nil, err
+	}
+	published, _, _ := publish(records, u.DuplicatePolicy)
+
+	hostsFile := *u.hostsFile
+	hostsFile.SetManaged(u.entries(published))
+	return hostsFile.Render(u.renderer()), nil
 }
 
-func (u *Updater) Run(string) {
+// Diff returns the unified diff between the hosts file on disk and what
+// Update would write, or "" when there is nothing to change.
+func (u *Updater) Diff() (string, error) {
+	rendered, err := u.Render()
+	if err != nil {
+		return "", err
+	}
+	w := u.writer()
+	current, err := w.Read()
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(w.String(), w.String()+".new", current, rendered), nil
+}
+
+// init reads the hosts file and works out the entry of this container the
+// first time it is called
+func (u *Updater) init() error {
+	if err := u.read(); err != nil {
+		return err
+	}
+	if u.self == nil {
+		self, err := u.selfEntries()
+		if err != nil {
+			// Retried on the next cycle, the rancher entries are
+			// written without it meanwhile
+			log.Errorf("Error getting the entry of this container: %v", err)
+		} else {
+			u.self = self
+			u.dirty = true
+		}
+	}
+	return nil
+}
+
+// read reads the hosts file the first time it is called
+func (u *Updater) read() error {
 	if u.rancherHosts == nil {
 		u.rancherHosts = make(map[string]string)
 	}
-	if u.origData == "" {
-		u.origData = `127.0.0.1    localhost
-::1    localhost ip6-localhost ip6-loopback
-fe00::0    ip6-localnet
-ff00::0    ip6-mcastprefix
-ff02::1    ip6-allnodes
-ff02::2    ip6-allrouters
-`
+	if u.hostsFile != nil {
+		return nil
+	}
+	data, err := u.writer().Read()
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", u.writer(), err)
+	}
+	u.original = data
+	u.current = data
+	u.hostsFile = ParseHosts(data)
+	return nil
+}
 
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Errorf("Error getting hostname of host: %v", err)
-			return
+// selfEntries returns the entries naming this container, one per address.
+// The name and addresses come from metadata; the hostname and resolving it
+// are only fallbacks for when metadata does not know them.
+func (u *Updater) selfEntries() ([]Entry, error) {
+	name, ips := u.selfFromMetadata()
+	if name != "" && !validHostname(name) {
+		// Container names may contain underscores
+		log.Infof("Name %q of this container is not a valid hostname, using the hostname", name)
+		name = ""
+	}
+	if name == "" {
+		var err error
+		if name, err = hostname(); err != nil {
+			return nil, fmt.Errorf("Error getting hostname of host: %v", err)
 		}
-		ips, err := net.LookupIP(hostname)
+	}
+
+	ips = u.addresses(name, ips, nil)
+	if len(ips) == 0 {
+		addrs, err := lookupIP(name)
 		if err != nil {
-			log.Errorf("Error getting IP addresses of host %s, err: %v", hostname, err)
-			return
+			return nil, fmt.Errorf("Error getting IP addresses of host %s, err: %v", name, err)
 		}
-		if len(ips) == 0 {
-			log.Errorf("Error getting IP address of host %s, err: No IPs found", hostname)
-			return
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
 		}
-		u.origData = u.origData + ips[0].String() + "    " + hostname
+		ips = u.addresses(name, ips, nil)
 	}
-	err := u.Update(u.rancherHosts)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("Error getting IP address of host %s, err: No IPs found", name)
+	}
+
+	entries := []Entry{}
+	for _, ip := range ips {
+		entries = append(entries, Entry{
+			IP:    ip,
+			Names: []string{name},
+		})
+	}
+	return entries, nil
+}
+
+// selfFromMetadata returns the name and addresses of this container from
+// metadata, either may be missing. Containers on the host network have no
+// addresses of their own and use the name and address of the host.
+func (u *Updater) selfFromMetadata() (string, []string) {
+	container, err := u.MetadataClient.GetSelfContainer()
 	if err != nil {
-		log.Errorf("Error updating /etc/hosts: [%v]", err)
+		log.Debugf("Error reading self container from metadata: %v", err)
+	} else if len(container.Ips) > 0 {
+		return container.Name, container.Ips
+	} else if container.PrimaryIp != "" {
+		return container.Name, []string{container.PrimaryIp}
+	}
+
+	host, err := u.MetadataClient.GetSelfHost()
+	if err != nil {
+		log.Debugf("Error reading self host from metadata: %v", err)
+	} else if host.AgentIP != "" {
+		return host.Hostname, []string{host.AgentIP}
+	}
+	return "", nil
+}
+
+// Reconfigure replaces the settings of u with those of next, keeping the
+// state of u and its MetadataClient. The next update writes the hosts file
+// even if no name changed, as the settings may change its content. A
+// different output is read again, Restore then puts back its content.
+func (u *Updater) Reconfigure(next *Updater) {
+	if next.writer().String() != u.writer().String() {
+		u.hostsFile = nil
+		u.wroteBlock = false
+	}
+	if next.AddressFamily != u.AddressFamily {
+		// Worked out again with the new family on the next update
+		u.self = nil
+	}
+	u.SortOrder = next.SortOrder
+	u.Sources = next.Sources
+	u.NameTemplates = next.NameTemplates
+	u.Selectors = next.Selectors
+	u.DuplicatePolicy = next.DuplicatePolicy
+	u.AddressFamily = next.AddressFamily
+	u.AddressLabels = next.AddressLabels
+	u.Writer = next.Writer
+	u.Renderer = next.Renderer
+	u.OnChange = next.OnChange
+	u.Guard.MaxRemovals = next.Guard.MaxRemovals
+	u.Guard.MaxRemovalPercent = next.Guard.MaxRemovalPercent
+	u.Guard.HoldCycles = next.Guard.HoldCycles
+	u.dirty = true
+}
+
+// Restore puts back the content the hosts file had before the updater
+// first read it. It does nothing if Run never got that far.
+func (u *Updater) Restore() error {
+	if u.hostsFile == nil {
+		return nil
 	}
+	log.Infof("Restoring original %s", u.writer())
+	_, err := u.writer().Write(u.original)
+	return err
 }
 
 func (u *Updater) Update(rancherHosts map[string]string) error {
-	hosts, err := u.MetadataClient.GetHosts()
+	records, err := u.records()
+	u.setStatus(func(s *status) {
+		s.metadataErr = err
+		if err != nil {
+			s.lastError = err
+			s.metadataErrors++
+		}
+	})
 	if err != nil {
 		return err
 	}
 
-	changed := false
+	published, hostsMap, duplicates := publish(records, u.DuplicatePolicy)
+	u.reportDuplicates(duplicates)
 
-	hostsMap := map[string]string{}
-
-	for _, host := range hosts {
-		if _, ok := hostsMap[host.Hostname]; ok {
-			// Do not add subsequent hosts with the
-			// duplicate hostnames
-			continue
-		}
-		if ip, ok := rancherHosts[host.Hostname]; !ok || ip != host.AgentIP {
-			// If the current host is not a part of the
-			// previous set of rancher hosts, then a new host
-			// was added
-			changed = true
-			log.Infof("Adding Host %s %s", host.Hostname, host.AgentIP)
-		}
-		hostsMap[host.Hostname] = host.AgentIP
+	// Called without Run, the hosts file was not read yet
+	if err := u.read(); err != nil {
+		u.setStatus(func(s *status) { s.lastError, s.writeErr = err, err })
+		return err
+	}
+	if _, err := u.refresh(); err != nil {
+		u.setStatus(func(s *status) { s.lastError, s.writeErr = err, err })
+		return err
 	}
 
-	for rHost := range rancherHosts {
-		// a host was deleted
-		if _, ok := hostsMap[rHost]; !ok {
-			log.Infof("Deleting host %s", rHost)
-			changed = true
+	changes := compareHosts(rancherHosts, hostsMap)
+	held := u.Guard.hold(len(changes.Removed), len(rancherHosts))
+	u.setStatus(func(s *status) {
+		s.holding = held
+		if held {
+			s.holds++
 		}
+	})
+	if held {
+		// Not a success, metadata answered with entries that are not
+		// applied
+		log.Warnf("Holding back update removing %d of %d entries, seen %d of %d times in a row",
+			len(changes.Removed), len(rancherHosts), u.Guard.held, u.Guard.HoldCycles)
+		return nil
 	}
 
-	if len(rancherHosts) != len(hostsMap) {
-		changed = true
+	if changes.empty() && !u.dirty {
+		u.setStatus(func(s *status) { s.lastUpdate = time.Now() })
+		return nil
 	}
 
-	if !changed {
-		return err
+	for _, name := range changes.Added {
+		log.Infof("Adding Host %s %s", name, hostsMap[name])
+	}
+	for _, name := range changes.Changed {
+		log.Infof("Changing Host %s %s -> %s", name, rancherHosts[name], hostsMap[name])
+	}
+	for _, name := range changes.Removed {
+		log.Infof("Deleting host %s", name)
 	}
 
 	// sycnchronize rancherHosts to be the same as
 	// the current view of rancher hosts from metadata service
+	u.lock.Lock()
 	for k := range rancherHosts {
 		delete(rancherHosts, k)
 	}
@@ -111,12 +333,203 @@ func (u *Updater) Update(rancherHosts map[string]string) error {
 	for k, v := range hostsMap {
 		rancherHosts[k] = v
 	}
+	u.lock.Unlock()
 
-	toWrite := u.origData + "\n"
+	u.hostsFile.SetManaged(u.entries(published))
+	if err := u.write(changes); err != nil {
+		return err
+	}
+	u.setStatus(func(s *status) { s.lastUpdate = time.Now() })
+	return nil
+}
 
-	for k, v := range hostsMap {
-		toWrite = toWrite + fmt.Sprintf("%s    %s\n", v, k)
+// write writes the hosts file, recording the outcome and calling OnChange
+// with changes if the content changed
+func (u *Updater) write(changes Change) error {
+	data := u.hostsFile.Render(u.renderer())
+	written, err := u.writer().Write(data)
+	u.setStatus(func(s *status) {
+		s.writeErr = err
+		s.writes++
+		if err != nil {
+			s.lastError = err
+			s.writeFailures++
+		} else {
+			s.applied = append([]Entry{}, u.hostsFile.Managed()...)
+			s.appliedHosts = make(map[string]string, len(u.rancherHosts))
+			for name, ips := range u.rancherHosts {
+				s.appliedHosts[name] = ips
+			}
+		}
+		s.hostsAdded += uint64(len(changes.Added))
+		s.hostsChanged += uint64(len(changes.Changed))
+		s.hostsRemoved += uint64(len(changes.Removed))
+	})
+	if err != nil {
+		// rancherHosts already holds the new names, retry the write
+		// on the next update even if they do not change
+		u.dirty = true
+		return err
+	}
+	u.dirty = false
+	u.wroteBlock = true
+	// Also when the output already had the content and was left alone,
+	// but a dry run leaves it as it was
+	if _, dryRun := u.writer().(dryRunWriter); written || !dryRun {
+		u.current = data
+	}
+
+	if written && u.OnChange != nil {
+		u.OnChange(changes)
+	}
+	return nil
+}
+
+// Repair writes the rancher-managed block again if another program changed
+// it since the last update, without reading metadata. It does nothing
+// before this process first wrote the block.
+func (u *Updater) Repair() error {
+	if !u.wroteBlock {
+		return nil
+	}
+	drifted, err := u.refresh()
+	if err != nil {
+		u.setStatus(func(s *status) { s.lastError, s.writeErr = err, err })
+		return err
+	}
+	if !drifted {
+		return nil
+	}
+	return u.write(Change{})
+}
+
+// refresh reads the output again when it differs from what was last read
+// or written. Changes outside the rancher-managed block are kept, changes
+// of the block are logged and reported, the next write repairs them.
+func (u *Updater) refresh() (bool, error) {
+	w := u.writer()
+	data, err := w.Read()
+	if err != nil {
+		return false, fmt.Errorf("Error reading %s: %v", w, err)
+	}
+	if bytes.Equal(data, u.current) {
+		return false, nil
+	}
+
+	hostsFile := ParseHosts(data)
+	u.current = data
+	if !u.wroteBlock {
+		// The block was parsed from disk, possibly in another format
+		// than hosts lines, it is replaced by the next write as is
+		u.hostsFile = hostsFile
+		return false, nil
+	}
+	hostsFile.SetManaged(u.hostsFile.Managed())
+	repaired := hostsFile.Render(u.renderer())
+	u.hostsFile = hostsFile
+	if bytes.Equal(data, repaired) {
+		log.Infof("%s was changed outside the rancher-managed block, keeping the changes", w)
+		return false, nil
+	}
+
+	log.Warnf("%s was changed by another program, repairing the rancher-managed block\n%s",
+		w, unifiedDiff(w.String(), w.String()+".repaired", data, repaired))
+	u.dirty = true
+	u.setStatus(func(s *status) { s.repairs++ })
+	return true, nil
+}
+
+// Duplicates returns the names claimed by more than one record in the last
+// update
+func (u *Updater) Duplicates() []Duplicate {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.duplicates
+}
+
+// reportDuplicates logs the duplicated names when they differ from the last
+// update, so a misconfigured host is reported once rather than every cycle
+func (u *Updater) reportDuplicates(duplicates []Duplicate) {
+	u.lock.Lock()
+	previous := u.duplicates
+	u.duplicates = duplicates
+	u.lock.Unlock()
+
+	if reflect.DeepEqual(duplicates, previous) || len(duplicates)+len(previous) == 0 {
+		return
+	}
+	for _, duplicate := range duplicates {
+		log.Warnf("Duplicate name %s, publishing per policy %s", duplicate, u.duplicatePolicy())
+	}
+	if len(duplicates) == 0 {
+		log.Info("No duplicate names left")
+	}
+}
+
+func (u *Updater) duplicatePolicy() DuplicatePolicy {
+	if u.DuplicatePolicy == "" {
+		return DuplicateFirst
+	}
+	return u.DuplicatePolicy
+}
+
+func (u *Updater) renderer() Renderer {
+	if u.Renderer == nil {
+		return HostsRenderer{}
+	}
+	return u.Renderer
+}
+
+func (u *Updater) writer() Writer {
+	if u.Writer == nil {
+		return FileWriter{hostsOrigFile}
 	}
+	return u.Writer
+}
+
+// Change lists the names that differ between two name to address maps
+type Change struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
 
-	return ioutil.WriteFile(hostsOrigFile, []byte(toWrite), 0644)
+func (c Change) empty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Removed) == 0
+}
+
+func compareHosts(old, current map[string]string) Change {
+	c := Change{}
+	for name, ip := range current {
+		if oldIP, ok := old[name]; !ok {
+			c.Added = append(c.Added, name)
+		} else if oldIP != ip {
+			c.Changed = append(c.Changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			c.Removed = append(c.Removed, name)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Changed)
+	sort.Strings(c.Removed)
+	return c
+}
+
+// entries sorts the published records into the managed block content
+func (u *Updater) entries(published []Record) []Entry {
+	sortRecords(published, u.SortOrder)
+
+	entries := append([]Entry{}, u.self...)
+	for _, record := range published {
+		for _, ip := range record.IPs {
+			entries = append(entries, Entry{
+				IP:    ip,
+				Names: record.Names,
+			})
+		}
+	}
+	return entries
 }
@@ -1,54 +1,99 @@
 package updater
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/selector"
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 var upd *Updater
 var client *fakeMetadataClient
+var output *memWriter
 
 func init() {
 	client = &fakeMetadataClient{
 		hosts: []metadata.Host{
 			{
 				Hostname: "Host1",
-				AgentIP:  "IP1",
+				AgentIP:  "10.1.0.1",
 			},
 		},
 		lock: &sync.Mutex{},
 	}
+	output = &memWriter{}
 
 	upd = &Updater{
 		rancherHosts:   make(map[string]string),
 		MetadataClient: client,
+		Writer:         output,
 	}
 }
 
+// memWriter keeps the hosts file in memory
+type memWriter struct {
+	data   []byte
+	writes int
+}
+
+func (m *memWriter) String() string {
+	return "memory"
+}
+
+func (m *memWriter) Read() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *memWriter) Write(data []byte) (bool, error) {
+	changed := !bytes.Equal(m.data, data)
+	m.data = append([]byte(nil), data...)
+	m.writes++
+	return changed, nil
+}
+
 type fakeMetadataClient struct {
-	hosts []metadata.Host
-	lock  *sync.Mutex
+	selfContainer metadata.Container
+	selfHost      metadata.Host
+	hosts         []metadata.Host
+	containers    []metadata.Container
+	services      []metadata.Service
+	lock          *sync.Mutex
+}
+
+func (f *fakeMetadataClient) GetSelfContainer() (metadata.Container, error) {
+	return f.selfContainer, nil
+}
+
+func (f *fakeMetadataClient) GetSelfHost() (metadata.Host, error) {
+	return f.selfHost, nil
 }
 
 func (f *fakeMetadataClient) GetHosts() ([]metadata.Host, error) {
 	return f.hosts, nil
 }
 
-func TestMain(m *testing.M) {
-	tmpFile, err := ioutil.TempFile("", "hosts")
-	if err != nil {
-		log.Fatalf("Error running test, Could not create Temp file [%v]", err)
-	}
-	upd.origData = "127.0.0.1    localhost localhost-ip4"
-	hostsOrigFile = tmpFile.Name()
+func (f *fakeMetadataClient) GetContainers() ([]metadata.Container, error) {
+	return f.containers, nil
+}
 
-	defer os.Remove(hostsOrigFile)
+func (f *fakeMetadataClient) GetServices() ([]metadata.Service, error) {
+	return f.services, nil
+}
+
+func TestMain(m *testing.M) {
+	upd.self = []Entry{{
+		IP:    "127.0.0.1",
+		Names: []string{"localhost", "localhost-ip4"},
+	}}
 
 	os.Exit(m.Run())
 }
@@ -58,11 +103,11 @@ func TestDetectsHostIpChange(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP1",
+			AgentIP:  "10.1.0.1",
 		},
 	}
 	upd.Run("")
-	hostsMap, err := parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err := parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -74,8 +119,8 @@ func TestDetectsHostIpChange(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP1" {
-		t.Fatalf("Entry for Host1 not found to be IP1 as set, after running updater service with Host1 data")
+	if v != "10.1.0.1" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.1 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -88,11 +133,11 @@ func TestDetectsHostIpChange(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP2",
+			AgentIP:  "10.1.0.2",
 		},
 	}
 	upd.Run("")
-	hostsMap, err = parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err = parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -104,8 +149,8 @@ func TestDetectsHostIpChange(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP2" {
-		t.Fatalf("Entry for Host1 not found to be IP2 as set, after running updater service with Host1 data")
+	if v != "10.1.0.2" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.2 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -121,11 +166,11 @@ func TestDetectsHostAddition(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP1",
+			AgentIP:  "10.1.0.1",
 		},
 	}
 	upd.Run("")
-	hostsMap, err := parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err := parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -137,8 +182,8 @@ func TestDetectsHostAddition(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP1" {
-		t.Fatalf("Entry for Host1 not found to be IP1 as set, after running updater service with Host1 data")
+	if v != "10.1.0.1" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.1 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -151,15 +196,15 @@ func TestDetectsHostAddition(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP1",
+			AgentIP:  "10.1.0.1",
 		},
 		{
 			Hostname: "Host2",
-			AgentIP:  "IP2",
+			AgentIP:  "10.1.0.2",
 		},
 	}
 	upd.Run("")
-	hostsMap, err = parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err = parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -171,15 +216,15 @@ func TestDetectsHostAddition(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP1" {
-		t.Fatalf("Entry for Host1 not found to be IP2 as set, after running updater service with Host1 data")
+	if v != "10.1.0.1" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.2 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["Host2"]
 	if !ok {
 		t.Fatalf("Entry for Host2 not found after running updater service with Host2 data")
 	}
-	if v != "IP2" {
-		t.Fatalf("Entry for Host1 not found to be IP2 as set, after running updater service with Host1 data")
+	if v != "10.1.0.2" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.2 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -195,15 +240,15 @@ func TestDetectsHostDeletion(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP1",
+			AgentIP:  "10.1.0.1",
 		},
 		{
 			Hostname: "Host2",
-			AgentIP:  "IP2",
+			AgentIP:  "10.1.0.2",
 		},
 	}
 	upd.Run("")
-	hostsMap, err := parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err := parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -215,15 +260,15 @@ func TestDetectsHostDeletion(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP1" {
-		t.Fatalf("Entry for Host1 not found to be IP2 as set, after running updater service with Host1 data")
+	if v != "10.1.0.1" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.2 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["Host2"]
 	if !ok {
 		t.Fatalf("Entry for Host2 not found after running updater service with Host2 data")
 	}
-	if v != "IP2" {
-		t.Fatalf("Entry for Host1 not found to be IP2 as set, after running updater service with Host1 data")
+	if v != "10.1.0.2" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.2 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -236,11 +281,11 @@ func TestDetectsHostDeletion(t *testing.T) {
 	client.hosts = []metadata.Host{
 		{
 			Hostname: "Host1",
-			AgentIP:  "IP1",
+			AgentIP:  "10.1.0.1",
 		},
 	}
 	upd.Run("")
-	hostsMap, err = parseHostsOrigFile(hostsOrigFile)
+	hostsMap, err = parseHostsOrigFile(output)
 	client.lock.Unlock()
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -252,8 +297,8 @@ func TestDetectsHostDeletion(t *testing.T) {
 	if !ok {
 		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
 	}
-	if v != "IP1" {
-		t.Fatalf("Entry for Host1 not found to be IP1 as set, after running updater service with Host1 data")
+	if v != "10.1.0.1" {
+		t.Fatalf("Entry for Host1 not found to be 10.1.0.1 as set, after running updater service with Host1 data")
 	}
 	v, ok = hostsMap["localhost"]
 	if !ok {
@@ -264,8 +309,405 @@ func TestDetectsHostDeletion(t *testing.T) {
 	}
 }
 
-func parseHostsOrigFile(file string) (map[string]string, error) {
-	data, err := ioutil.ReadFile(file)
+func TestPreservesUserContent(t *testing.T) {
+	head := "# added by docker\n10.0.0.5\tdb  db.local # pinned\n"
+	tail := "\n10.0.0.6    cache\n"
+	w := &memWriter{data: []byte(head + beginMarker + "\n10.1.0.9    stale\n" + endMarker + "\n" + tail)}
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+				},
+			},
+		},
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+		Writer: w,
+	}
+	u.Run("")
+
+	expected := head + beginMarker + "\n127.0.0.1    localhost\n10.1.0.1    Host1\n" + endMarker + "\n" + tail
+	if string(w.data) != expected {
+		t.Fatalf("Expected hosts file\n%q\nfound\n%q", expected, string(w.data))
+	}
+}
+
+func TestPublishesContainersAndServices(t *testing.T) {
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+				},
+			},
+			containers: []metadata.Container{
+				{
+					Name:      "web-1",
+					PrimaryIp: "10.1.0.2",
+				},
+				{
+					Name: "stopped-1",
+				},
+			},
+			services: []metadata.Service{
+				{
+					Name:      "web",
+					StackName: "app",
+					Vip:       "10.1.0.3",
+				},
+				{
+					Name:      "novip",
+					StackName: "app",
+				},
+			},
+		},
+		Sources: []Source{SourceContainers, SourceServices},
+		Writer:  w,
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+	}
+	u.Run("")
+
+	hostsMap, err := parseHostsOrigFile(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hostsMap) != 3 {
+		t.Fatalf("Expected 3 entires, found %d", len(hostsMap))
+	}
+	if hostsMap["web-1"] != "10.1.0.2" {
+		t.Fatalf("Expected container web-1 to map to 10.1.0.2, found %q", hostsMap["web-1"])
+	}
+	if hostsMap["web.app"] != "10.1.0.3" {
+		t.Fatalf("Expected service web.app to map to 10.1.0.3, found %q", hostsMap["web.app"])
+	}
+	if _, ok := hostsMap["Host1"]; ok {
+		t.Fatalf("Expected hosts not to be published when the hosts source is disabled")
+	}
+}
+
+func TestFiltersBySelector(t *testing.T) {
+	hostSelector, err := selector.Parse("role in (db,cache),!hosts.exclude")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+					Labels:   map[string]string{"role": "db"},
+				},
+				{
+					Hostname: "Host2",
+					AgentIP:  "10.1.0.2",
+					Labels:   map[string]string{"role": "db", "hosts.exclude": "true"},
+				},
+				{
+					Hostname: "Host3",
+					AgentIP:  "10.1.0.3",
+					Labels:   map[string]string{"role": "web"},
+				},
+				{
+					Hostname: "Host4",
+					AgentIP:  "10.1.0.4",
+				},
+			},
+		},
+		Selectors: Selectors{Host: hostSelector},
+		Writer:    w,
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+	}
+	u.Run("")
+
+	hostsMap, err := parseHostsOrigFile(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hostsMap) != 2 {
+		t.Fatalf("Expected 2 entires, found %d", len(hostsMap))
+	}
+	if _, ok := hostsMap["Host1"]; !ok {
+		t.Fatalf("Expected Host1 matching the selector to be published")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	orig := "127.0.0.1 localhost\n"
+	w := &memWriter{data: []byte(orig)}
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+				},
+			},
+		},
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+		Writer: w,
+	}
+	if err := u.Restore(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if w.writes != 0 {
+		t.Fatalf("Expected no write before the first update")
+	}
+
+	u.Run("")
+	hostsMap, err := parseHostsOrigFile(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := hostsMap["Host1"]; !ok {
+		t.Fatalf("Entry for Host1 not found after running updater service with Host1 data")
+	}
+
+	if err := u.Restore(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(w.data) != orig {
+		t.Fatalf("Expected %q after restore, found %q", orig, string(w.data))
+	}
+}
+
+func TestDryRunDoesNotWrite(t *testing.T) {
+	w := &memWriter{data: []byte("127.0.0.1 localhost\n")}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{
+				{
+					Hostname: "Host1",
+					AgentIP:  "10.1.0.1",
+				},
+			},
+		},
+		self: []Entry{{
+			IP:    "127.0.0.1",
+			Names: []string{"localhost"},
+		}},
+		Writer: DryRun(w),
+	}
+	u.Run("")
+
+	if w.writes != 0 || string(w.data) != "127.0.0.1 localhost\n" {
+		t.Fatalf("Expected dry run not to write, found %d writes", w.writes)
+	}
+	if len(u.rancherHosts) != 1 {
+		t.Fatalf("Expected dry run to track 1 host, found %d", len(u.rancherHosts))
+	}
+
+	u.dirty = true
+	u.Run("")
+	if m := u.Metrics(); m.Repairs != 0 {
+		t.Fatalf("Expected the unwritten content not to be taken for a change, got %+v", m)
+	}
+}
+
+func TestSkippedWriteIsCurrent(t *testing.T) {
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+		},
+		Writer: w,
+		self:   []Entry{},
+	}
+	u.Run("")
+
+	// The output already has the content, memWriter reports no change
+	u.current = []byte("stale")
+	if err := u.write(Change{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(u.current, w.data) {
+		t.Fatalf("Expected %q to be current, found %q", w.data, u.current)
+	}
+}
+
+func TestSelfEntryFromMetadata(t *testing.T) {
+	defer stubSelfLookup("self", nil, fmt.Errorf("no DNS"))()
+
+	client := &fakeMetadataClient{
+		selfContainer: metadata.Container{
+			PrimaryIp: "10.42.0.5",
+			Ips:       []string{"10.42.0.5", "fd00::5"},
+		},
+		selfHost: metadata.Host{
+			AgentIP: "192.168.0.10",
+		},
+	}
+	u := &Updater{
+		MetadataClient: client,
+	}
+	self, err := u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []Entry{
+		{IP: "10.42.0.5", Names: []string{"self"}},
+		{IP: "fd00::5", Names: []string{"self"}},
+	}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+
+	// Containers on the host network have no address of their own
+	client.selfContainer = metadata.Container{}
+	self, err = u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = []Entry{{IP: "192.168.0.10", Names: []string{"self"}}}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+}
+
+func TestSelfEntryNameFromMetadata(t *testing.T) {
+	defer stubSelfLookup("self", nil, fmt.Errorf("no DNS"))()
+	hostname = func() (string, error) {
+		return "", fmt.Errorf("no hostname")
+	}
+
+	client := &fakeMetadataClient{
+		selfContainer: metadata.Container{
+			Name:      "web-1",
+			PrimaryIp: "10.42.0.5",
+		},
+		selfHost: metadata.Host{
+			Hostname: "host1",
+			AgentIP:  "192.168.0.10",
+		},
+	}
+	u := &Updater{
+		MetadataClient: client,
+	}
+	self, err := u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []Entry{{IP: "10.42.0.5", Names: []string{"web-1"}}}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+
+	// Names that are not valid hostnames are replaced by the hostname
+	hostname = func() (string, error) {
+		return "self", nil
+	}
+	client.selfContainer.Name = "stack_web_1"
+	self, err = u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = []Entry{{IP: "10.42.0.5", Names: []string{"self"}}}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+
+	// On the host network the container is named like the host
+	client.selfContainer = metadata.Container{Name: "web-1"}
+	self, err = u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = []Entry{{IP: "192.168.0.10", Names: []string{"host1"}}}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+}
+
+func TestSelfEntryFallsBackToDNS(t *testing.T) {
+	defer stubSelfLookup("self", []net.IP{net.ParseIP("10.0.0.7")}, nil)()
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{},
+	}
+	self, err := u.selfEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []Entry{{IP: "10.0.0.7", Names: []string{"self"}}}
+	if !reflect.DeepEqual(self, expected) {
+		t.Fatalf("Expected %v, found %v", expected, self)
+	}
+}
+
+func TestSelfEntryFailureDoesNotBlockUpdate(t *testing.T) {
+	defer stubSelfLookup("self", nil, fmt.Errorf("no DNS"))()
+
+	client := &fakeMetadataClient{
+		hosts: []metadata.Host{
+			{
+				Hostname: "Host1",
+				AgentIP:  "10.1.0.1",
+			},
+		},
+	}
+	w := &memWriter{}
+	u := &Updater{
+		MetadataClient: client,
+		Writer:         w,
+	}
+	u.Run("")
+
+	hostsMap, err := parseHostsOrigFile(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hostsMap) != 1 || hostsMap["Host1"] != "10.1.0.1" {
+		t.Fatalf("Expected only Host1 without the self entry, found %v", hostsMap)
+	}
+
+	// Once metadata knows the container, its entry is added even though
+	// no rancher host changed
+	client.selfContainer = metadata.Container{PrimaryIp: "10.42.0.5"}
+	u.Run("")
+	hostsMap, err = parseHostsOrigFile(w)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if hostsMap["self"] != "10.42.0.5" {
+		t.Fatalf("Expected self entry after metadata caught up, found %v", hostsMap)
+	}
+}
+
+// stubSelfLookup makes the hostname name and resolving it return ips and
+// err. The returned func restores the real lookups.
+func stubSelfLookup(name string, ips []net.IP, err error) func() {
+	origHostname, origLookupIP := hostname, lookupIP
+	hostname = func() (string, error) {
+		return name, nil
+	}
+	lookupIP = func(string) ([]net.IP, error) {
+		return ips, err
+	}
+	return func() {
+		hostname, lookupIP = origHostname, origLookupIP
+	}
+}
+
+func parseHostsOrigFile(w Writer) (map[string]string, error) {
+	data, err := w.Read()
 	if err != nil {
 		return nil, err
 	}
@@ -283,3 +725,183 @@ func parseHostsOrigFile(file string) (map[string]string, error) {
 	}
 	return hostsMap, nil
 }
+
+func TestOnChangeOnlyAfterWrite(t *testing.T) {
+	client := &fakeMetadataClient{
+		hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+	}
+	changes := []Change{}
+	u := &Updater{
+		MetadataClient: client,
+		Writer:         &memWriter{},
+		self:           []Entry{},
+		OnChange: func(c Change) {
+			changes = append(changes, c)
+		},
+	}
+
+	u.Run("1")
+	u.Run("1")
+	client.hosts = []metadata.Host{{Hostname: "Host2", AgentIP: "10.1.0.2"}}
+	u.Run("2")
+
+	expected := []Change{
+		{Added: []string{"Host1"}},
+		{Added: []string{"Host2"}, Removed: []string{"Host1"}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected changes %v, found %v", expected, changes)
+	}
+
+	u.Writer = DryRun(&memWriter{})
+	client.hosts = nil
+	u.Run("3")
+	if len(changes) != 2 {
+		t.Fatalf("Expected no change to be reported for a dry run, found %v", changes[2:])
+	}
+}
+
+func TestRepairsExternalChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "updater")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1    localhost\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	changes := 0
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+		},
+		Writer:   FileWriter{path},
+		self:     []Entry{},
+		OnChange: func(Change) { changes++ },
+	}
+	u.Run("1")
+	block := beginMarker + "\n10.1.0.1    Host1\n" + endMarker + "\n"
+	assertFile(t, path, "127.0.0.1    localhost\n"+block)
+
+	// Regenerated by docker, the block is gone
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1    localhost\n10.42.0.5    web\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := u.Repair(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	assertFile(t, path, "127.0.0.1    localhost\n10.42.0.5    web\n"+block)
+	if m := u.Metrics(); m.Repairs != 1 || changes != 2 {
+		t.Fatalf("Expected one repair to be counted and reported, got %+v and %d changes", m, changes)
+	}
+
+	// Edited inside the block, repaired by the next cycle although
+	// metadata did not change
+	edited := strings.Replace(readFile(t, path), "10.1.0.1", "10.9.9.9", 1)
+	if err := ioutil.WriteFile(path, []byte(edited), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u.Run("1")
+	assertFile(t, path, "127.0.0.1    localhost\n10.42.0.5    web\n"+block)
+	if m := u.Metrics(); m.Repairs != 2 {
+		t.Fatalf("Expected the second repair to be counted, got %+v", m)
+	}
+
+	// Edited outside the block, the edit is kept
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1    localhost\n"+block+"10.0.0.7    pinned\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := u.Repair(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	u.MetadataClient = &fakeMetadataClient{
+		hosts: []metadata.Host{{Hostname: "Host2", AgentIP: "10.1.0.2"}},
+	}
+	u.Run("2")
+	assertFile(t, path, "127.0.0.1    localhost\n"+beginMarker+"\n10.1.0.2    Host2\n"+endMarker+"\n10.0.0.7    pinned\n")
+	if m := u.Metrics(); m.Repairs != 2 {
+		t.Fatalf("Expected a change outside the block not to be repaired, got %+v", m)
+	}
+
+	// Removed, written again
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := u.Repair(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	assertFile(t, path, beginMarker+"\n10.1.0.2    Host2\n"+endMarker+"\n")
+}
+
+func TestRepairBeforeUpdate(t *testing.T) {
+	w := &memWriter{data: []byte("127.0.0.1    localhost\n")}
+	u := &Updater{MetadataClient: client, Writer: w}
+	if err := u.Repair(); err != nil || w.writes != 0 {
+		t.Fatalf("Expected nothing to be repaired before the first update, got %v", err)
+	}
+}
+
+func TestUpdateBeforeRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "updater")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+
+	u := &Updater{
+		MetadataClient: &fakeMetadataClient{
+			hosts: []metadata.Host{{Hostname: "Host1", AgentIP: "10.1.0.1"}},
+		},
+		Writer: FileWriter{path},
+	}
+	if err := u.Update(map[string]string{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	assertFile(t, path, beginMarker+"\n10.1.0.1    Host1\n"+endMarker+"\n")
+}
+
+func TestRepairBeforeFirstWrite(t *testing.T) {
+	block := beginMarker + "\nlocal-data: \"Host1. A 10.1.0.1\"\nlocal-data-ptr: \"10.1.0.1 Host1.\"\n" + endMarker + "\n"
+	w := &memWriter{data: []byte("server:\n" + block)}
+	u := &Updater{
+		MetadataClient: &erroringClient{},
+		Writer:         w,
+		Renderer:       UnboundRenderer{},
+		self:           []Entry{},
+	}
+	// Read, but not written as metadata fails
+	if err := u.Sync(); err == nil {
+		t.Fatalf("Expected the update to fail")
+	}
+
+	w.data = []byte("server:\n  verbosity: 1\n" + block)
+	if err := u.Repair(); err != nil || w.writes != 0 {
+		t.Fatalf("Expected a block this process did not write not to be repaired, got %v", err)
+	}
+
+	u.MetadataClient = &fakeMetadataClient{
+		hosts: []metadata.Host{{Hostname: "Host2", AgentIP: "10.1.0.2"}},
+	}
+	if err := u.Sync(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := "server:\n  verbosity: 1\n" + beginMarker +
+		"\nlocal-data: \"Host2. A 10.1.0.2\"\nlocal-data-ptr: \"10.1.0.2 Host2.\"\n" + endMarker + "\n"
+	if string(w.data) != expected {
+		t.Fatalf("Expected %q, found %q", expected, w.data)
+	}
+	if m := u.Metrics(); m.Repairs != 0 {
+		t.Fatalf("Expected no repair to be counted, got %+v", m)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return string(data)
+}
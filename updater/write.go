@@ -0,0 +1,199 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// rename and tempFile are swapped out in tests to simulate a
+	// bind-mounted target and a read-only directory
+	rename   = os.Rename
+	tempFile = ioutil.TempFile
+	// truncate is swapped out in tests to look at the file before it
+	truncate = (*os.File).Truncate
+)
+
+// Writer reads and replaces the hosts file managed by the updater
+type Writer interface {
+	fmt.Stringer
+	// Read returns the current content, nil if there is none yet
+	Read() ([]byte, error)
+	// Write replaces the content with data and reports whether that
+	// changed it
+	Write(data []byte) (bool, error)
+}
+
+// FileWriter writes a file on disk. Writes that would not change the
+// content are skipped, others are atomic as described for writeFile.
+type FileWriter struct {
+	Path string
+}
+
+func (f FileWriter) String() string {
+	return f.Path
+}
+
+func (f FileWriter) Read() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f FileWriter) Write(data []byte) (bool, error) {
+	current, err := f.Read()
+	if err == nil && current != nil && sha256.Sum256(current) == sha256.Sum256(data) {
+		log.Debugf("%s is up to date", f.Path)
+		return false, nil
+	}
+	if err := writeFile(f.Path, data, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type dryRunWriter struct {
+	Writer
+}
+
+// DryRun wraps w so that writes only log the diff they would apply
+func DryRun(w Writer) Writer {
+	return dryRunWriter{w}
+}
+
+func (d dryRunWriter) Write(data []byte) (bool, error) {
+	current, err := d.Read()
+	if err != nil {
+		return false, err
+	}
+	diff := unifiedDiff(d.String(), d.String()+".new", current, data)
+	if diff == "" {
+		log.Infof("Dry run: %s is up to date", d)
+		return false, nil
+	}
+	log.Infof("Dry run: not writing %s\n%s", d, diff)
+	return false, nil
+}
+
+// writeFile replaces the content of path without exposing a partially
+// written file to readers. A regular file is replaced by writing a temp
+// file next to it and renaming it over the target. Docker bind-mounts
+// /etc/hosts into the container, which makes the rename fail with EBUSY or
+// EXDEV, and with a read-only root filesystem the temp file can not be
+// created; in those cases, and for targets that are not regular files, the
+// file is overwritten in place with a single write and read back to verify
+// it.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	if info, err := os.Lstat(path); err == nil {
+		perm = info.Mode().Perm()
+		if !info.Mode().IsRegular() {
+			log.Debugf("%s is not a regular file, overwriting in place", path)
+			return overwrite(path, data, perm)
+		}
+	}
+
+	err := writeAtomic(path, data, perm)
+	if err == nil || !(isRenameBusy(err) || isTempDenied(err)) {
+		return err
+	}
+
+	log.Debugf("Can not replace %s (%v), overwriting in place", path, err)
+	return overwrite(path, data, perm)
+}
+
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := tempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return rename(tmp.Name(), path)
+}
+
+// overwrite writes data over the existing content before truncating, so a
+// concurrent reader never observes an empty file. Shorter content is padded
+// with newlines up to the old length in the same write, so until the
+// truncate it is followed by blank lines rather than by the tail of the old
+// content.
+func overwrite(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	padded := data
+	if info, err := f.Stat(); err == nil && info.Size() > int64(len(data)) {
+		padded = append(append([]byte{}, data...), bytes.Repeat([]byte("\n"), int(info.Size())-len(data))...)
+	}
+	if _, err := f.Write(padded); err != nil {
+		return err
+	}
+	if err := truncate(f, int64(len(data))); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(written, data) {
+		return fmt.Errorf("Content of %s does not match what was written", path)
+	}
+	return nil
+}
+
+// isTempDenied reports whether err is the failure to create the temp file
+// in a directory that can not be written
+func isTempDenied(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	if !ok || pathErr.Op != "open" {
+		return false
+	}
+	return pathErr.Err == syscall.EROFS || pathErr.Err == syscall.EACCES
+}
+
+func isRenameBusy(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	if !ok {
+		return false
+	}
+	return linkErr.Err == syscall.EBUSY || linkErr.Err == syscall.EXDEV
+}
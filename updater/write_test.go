@@ -0,0 +1,186 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("old content that is longer\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := writeFile(path, []byte("new\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	assertFile(t, path, "new\n")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected mode of the existing file to be kept, found %v", info.Mode())
+	}
+	assertNoTempFiles(t, dir)
+}
+
+func TestWriteFileFallsBackWhenRenameBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	for _, errno := range []syscall.Errno{syscall.EBUSY, syscall.EXDEV} {
+		rename = func(oldpath, newpath string) error {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errno}
+		}
+
+		path := filepath.Join(dir, "hosts")
+		if err := ioutil.WriteFile(path, []byte("old content that is longer\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := writeFile(path, []byte("new\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		assertFile(t, path, "new\n")
+		assertNoTempFiles(t, dir)
+	}
+}
+
+func TestWriteFileFallsBackWhenTempFileDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig func(string, string) (*os.File, error)) { tempFile = orig }(tempFile)
+	for _, errno := range []syscall.Errno{syscall.EROFS, syscall.EACCES} {
+		tempFile = func(dir, prefix string) (*os.File, error) {
+			return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, prefix), Err: errno}
+		}
+
+		path := filepath.Join(dir, "hosts")
+		if err := ioutil.WriteFile(path, []byte("old content that is longer\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := writeFile(path, []byte("new\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		assertFile(t, path, "new\n")
+	}
+}
+
+func TestWriteFileOverwritesIrregularFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	rename = func(oldpath, newpath string) error {
+		t.Fatalf("Expected %s not to be replaced", newpath)
+		return nil
+	}
+	path := filepath.Join(dir, "hosts")
+	if err := os.Symlink(os.DevNull, path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Truncating a device may fail, it is written to in place either way
+	writeFile(path, []byte("new\n"), 0644)
+	if info, err := os.Stat(os.DevNull); err != nil || info.Mode().IsRegular() {
+		t.Fatalf("Expected %s to be left a device, got %v", os.DevNull, err)
+	}
+}
+
+func TestWriteFileReturnsOtherRenameErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+	}
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := writeFile(path, []byte("new\n"), 0644); err == nil {
+		t.Fatalf("Expected rename error to be returned")
+	}
+	assertFile(t, path, "old\n")
+	assertNoTempFiles(t, dir)
+}
+
+func TestOverwritePadsShorterContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	old := "10.0.0.1 db\n10.0.0.2 web\n"
+	if err := ioutil.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// What a concurrent reader sees between the write and the truncate
+	intermediate := ""
+	defer func(orig func(*os.File, int64) error) { truncate = orig }(truncate)
+	truncate = func(f *os.File, size int64) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		intermediate = string(data)
+		return f.Truncate(size)
+	}
+
+	if err := overwrite(path, []byte("10.0.0.1 db\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := "10.0.0.1 db\n" + strings.Repeat("\n", len(old)-len("10.0.0.1 db\n")); intermediate != expected {
+		t.Fatalf("Expected the new content followed by blank lines before truncating, found %q", intermediate)
+	}
+	assertFile(t, path, "10.0.0.1 db\n")
+}
+
+func assertFile(t *testing.T, path, expected string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(data) != expected {
+		t.Fatalf("Expected %s to contain %q, found %q", path, expected, string(data))
+	}
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the target file in %s, found %d files", dir, len(files))
+	}
+}
@@ -0,0 +1,234 @@
+// Package watcher notices changes of the rancher-metadata version. It uses
+// the blocking ?wait=true&value=<version> requests of the metadata service
+// and falls back to polling /version when they are not supported.
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/etc-host-updater/backoff"
+	"github.com/rancher/etc-host-updater/metadataclient"
+)
+
+const (
+	// requestSlack is added to the wait timeout for the HTTP request
+	// deadline, so the metadata service can answer a wait that ran to
+	// its full length
+	requestSlack = 10 * time.Second
+	// waitProbeInterval is how long a watcher polls before trying wait
+	// requests again, in case the metadata service was upgraded
+	waitProbeInterval = 10 * time.Minute
+)
+
+// waitUnsupported are the statuses a metadata service answers a wait
+// request with when it does not know the parameters; others are errors
+var waitUnsupported = map[int]bool{
+	http.StatusBadRequest:       true,
+	http.StatusNotFound:         true,
+	http.StatusMethodNotAllowed: true,
+}
+
+type statusError struct {
+	code int
+	path string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("Error %v accessing %v path", e.code, e.path)
+}
+
+type Watcher struct {
+	// Resync calls do again with the current version when no change
+	// arrived for this long, 0 disables it
+	Resync time.Duration
+	// ResyncIf, if set, limits resyncs to when it returns true, checked
+	// before every wait for a change
+	ResyncIf func() bool
+	// OnError, if set, is called with every error reading the version
+	OnError func(error)
+	// OnSuccess, if set, is called after every successful read of the
+	// version, changed or not
+	OnSuccess func()
+	// Retry spaces the requests after errors, by default every interval
+	Retry backoff.Policy
+
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+	polling  bool
+	// pollingSince is when the watcher fell back to polling
+	pollingSince time.Time
+}
+
+// New returns a watcher for the metadata service at url. A wait request
+// blocks for at most timeout; interval is the delay between requests when
+// the service does not support waiting.
+func New(url string, interval, timeout time.Duration) *Watcher {
+	return &Watcher{
+		url:      strings.TrimSuffix(url, "/"),
+		interval: interval,
+		timeout:  timeout,
+		client: &http.Client{
+			Timeout: timeout + requestSlack,
+		},
+		Retry: backoff.Policy{
+			Initial: interval,
+			Max:     interval,
+		},
+	}
+}
+
+// Watch calls do with the initial metadata version and with every version
+// after it, until ctx is done or the Retry policy gives up after errors,
+// which is returned. do is never interrupted, Watch returns once the call
+// in progress has finished.
+func (w *Watcher) Watch(ctx context.Context, do func(string)) error {
+	version := "init"
+	retry := w.Retry.New()
+	for {
+		newVersion, err := w.nextOrResync(ctx, version)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == context.DeadlineExceeded {
+			log.Debugf("Resyncing metadata version %s", version)
+			do(version)
+			continue
+		}
+		if err != nil {
+			if w.OnError != nil {
+				w.OnError(err)
+			}
+			delay, ok := retry.Next()
+			if !ok {
+				return fmt.Errorf("Error reading metadata version, giving up: %v", err)
+			}
+			log.Errorf("Error reading metadata version, retrying in %v: %v", delay, err)
+			if !retry.Wait(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+		retry.Reset()
+		log.Debugf("Metadata Version has been changed. Old version: %s. New version: %s.", version, newVersion)
+		version = newVersion
+		do(newVersion)
+	}
+}
+
+// Next blocks until the metadata version differs from version and returns
+// the new one, or until ctx is done.
+func (w *Watcher) Next(ctx context.Context, version string) (string, error) {
+	for {
+		newVersion, err := w.poll(ctx, version)
+		if err != nil {
+			return "", err
+		}
+		if w.OnSuccess != nil {
+			w.OnSuccess()
+		}
+		if newVersion != version {
+			return newVersion, nil
+		}
+		log.Debug("No changes in metadata version")
+		if w.polling && !sleep(ctx, w.interval) {
+			return "", ctx.Err()
+		}
+	}
+}
+
+// nextOrResync is Next, giving up with context.DeadlineExceeded after the
+// resync period
+func (w *Watcher) nextOrResync(ctx context.Context, version string) (string, error) {
+	if w.Resync <= 0 || version == "init" || (w.ResyncIf != nil && !w.ResyncIf()) {
+		return w.Next(ctx, version)
+	}
+	resyncCtx, cancel := context.WithTimeout(ctx, w.Resync)
+	defer cancel()
+
+	newVersion, err := w.Next(resyncCtx, version)
+	if err != nil && ctx.Err() == nil && resyncCtx.Err() == context.DeadlineExceeded {
+		return "", context.DeadlineExceeded
+	}
+	return newVersion, err
+}
+
+// sleep waits for d and reports false if ctx was done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context, version string) (string, error) {
+	if w.polling && time.Since(w.pollingSince) >= waitProbeInterval {
+		log.Debug("Trying wait requests again")
+		w.polling = false
+	}
+	if w.polling {
+		return w.get(ctx, "/version")
+	}
+
+	maxWait := int((w.timeout + time.Second - 1) / time.Second)
+	path := fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d", url.QueryEscape(version), maxWait)
+
+	start := time.Now()
+	newVersion, err := w.get(ctx, path)
+	if status, ok := err.(statusError); ok && waitUnsupported[status.code] {
+		log.Infof("Metadata rejected wait request (%v), polling every %v", err, w.interval)
+		w.startPolling()
+		return w.get(ctx, "/version")
+	} else if err != nil {
+		return "", err
+	}
+
+	// A service that ignores wait answers an unchanged version right away
+	if newVersion == version && time.Since(start) < w.timeout/2 {
+		log.Infof("Metadata does not support wait requests, polling every %v", w.interval)
+		w.startPolling()
+	}
+	return newVersion, nil
+}
+
+func (w *Watcher) startPolling() {
+	w.polling = true
+	w.pollingSince = time.Now()
+}
+
+func (w *Watcher) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest("GET", w.url+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError{resp.StatusCode, path}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return metadataclient.ParseVersion(body), nil
+}
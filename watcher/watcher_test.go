@@ -0,0 +1,451 @@
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/etc-host-updater/backoff"
+)
+
+// fakeMetadata stands in for rancher-metadata's /version endpoint
+type fakeMetadata struct {
+	sync.Mutex
+	version      string
+	changed      chan struct{}
+	supportsWait bool
+	// waitStatus, if set, answers wait requests
+	waitStatus   int
+	waitRequests int
+}
+
+func newFakeMetadata(version string) *fakeMetadata {
+	return &fakeMetadata{
+		version: version,
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeMetadata) setVersion(version string) {
+	f.Lock()
+	defer f.Unlock()
+	f.version = version
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeMetadata) waits() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.waitRequests
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/2015-12-19/version" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.Lock()
+	version, changed := f.version, f.changed
+	wait := r.URL.Query().Get("wait") == "true"
+	if wait {
+		f.waitRequests++
+	}
+	f.Unlock()
+
+	if wait && f.waitStatus != 0 {
+		http.Error(w, http.StatusText(f.waitStatus), f.waitStatus)
+		return
+	}
+	if wait && f.supportsWait && r.URL.Query().Get("value") == version {
+		select {
+		case <-changed:
+		case <-time.After(150 * time.Millisecond):
+		}
+		f.Lock()
+		version = f.version
+		f.Unlock()
+	}
+	w.Write([]byte(`"` + version + `"`))
+}
+
+func TestNextWaitsForChange(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	metadata.supportsWait = true
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	w := New(server.URL+"/2015-12-19", time.Hour, 200*time.Millisecond)
+	if version, err := w.Next(context.Background(), "init"); err != nil || version != "1" {
+		t.Fatalf("Expected initial version 1, got %q %v", version, err)
+	}
+
+	go func() {
+		time.Sleep(400 * time.Millisecond)
+		metadata.setVersion("2")
+	}()
+	version, err := w.Next(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if version != "2" {
+		t.Fatalf("Expected version 2, found %q", version)
+	}
+	if w.polling {
+		t.Fatalf("Expected watcher to keep using wait requests")
+	}
+	if metadata.waits() < 3 {
+		t.Fatalf("Expected waits to time out and be repeated, found %d wait requests", metadata.waits())
+	}
+}
+
+func TestNextFallsBackWhenWaitIgnored(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	w := New(server.URL+"/2015-12-19/", 10*time.Millisecond, time.Minute)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		metadata.setVersion("2")
+	}()
+	version, err := w.Next(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if version != "2" {
+		t.Fatalf("Expected version 2, found %q", version)
+	}
+	if !w.polling {
+		t.Fatalf("Expected watcher to fall back to polling")
+	}
+	if metadata.waits() != 1 {
+		t.Fatalf("Expected a single wait request, found %d", metadata.waits())
+	}
+}
+
+func TestNextFallsBackWhenWaitRejected(t *testing.T) {
+	metadata := newFakeMetadata("2")
+	metadata.waitStatus = http.StatusBadRequest
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	w := New(server.URL+"/2015-12-19", 10*time.Millisecond, time.Minute)
+	version, err := w.Next(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if version != "2" {
+		t.Fatalf("Expected version 2, found %q", version)
+	}
+	if !w.polling {
+		t.Fatalf("Expected watcher to fall back to polling")
+	}
+}
+
+func TestNextKeepsWaitingAfterServerErrors(t *testing.T) {
+	metadata := newFakeMetadata("2")
+	metadata.waitStatus = http.StatusServiceUnavailable
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	w := New(server.URL+"/2015-12-19", 10*time.Millisecond, time.Minute)
+	if _, err := w.Next(context.Background(), "1"); err == nil {
+		t.Fatalf("Expected the unavailable service to be an error")
+	}
+	if w.polling {
+		t.Fatalf("Expected watcher to keep using wait requests")
+	}
+}
+
+func TestPollingProbesWaitAgain(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	metadata.supportsWait = true
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	w := New(server.URL+"/2015-12-19", 10*time.Millisecond, 200*time.Millisecond)
+	w.startPolling()
+	if _, err := w.poll(context.Background(), "1"); err != nil || metadata.waits() != 0 {
+		t.Fatalf("Expected a plain request while polling, got %v and %d waits", err, metadata.waits())
+	}
+
+	w.pollingSince = time.Now().Add(-waitProbeInterval)
+	if _, err := w.poll(context.Background(), "1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if metadata.waits() != 1 || w.polling {
+		t.Fatalf("Expected wait requests to be tried again, found %d waits", metadata.waits())
+	}
+}
+
+func TestNextReturnsErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	w := New(server.URL, 10*time.Millisecond, time.Minute)
+	w.polling = true
+	if _, err := w.Next(context.Background(), "1"); err == nil {
+		t.Fatalf("Expected error for missing version endpoint")
+	}
+}
+
+func TestWatchStopsOnCancel(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	metadata.supportsWait = true
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := New(server.URL+"/2015-12-19", time.Hour, time.Hour)
+
+	versions := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		w.Watch(ctx, func(version string) {
+			versions <- version
+		})
+		close(done)
+	}()
+
+	if version := <-versions; version != "1" {
+		t.Fatalf("Expected initial version 1, found %q", version)
+	}
+
+	// Watch is now blocked in a wait request that would last an hour
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Watch to return after the context was cancelled")
+	}
+}
+
+func TestWatchStopsWhilePolling(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := New(server.URL, time.Hour, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		w.Watch(ctx, func(string) {
+			t.Errorf("Expected no update after the context was cancelled")
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Watch to return after the context was cancelled")
+	}
+}
+
+func TestWatchResyncs(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	metadata.supportsWait = true
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := New(server.URL+"/2015-12-19", time.Hour, time.Hour)
+	w.Resync = 50 * time.Millisecond
+
+	versions := make(chan string, 10)
+	go w.Watch(ctx, func(version string) {
+		versions <- version
+	})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case version := <-versions:
+			if version != "1" {
+				t.Fatalf("Expected version 1, found %q", version)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the unchanged version to be resynced")
+		}
+	}
+}
+
+func TestWatchResyncsOnlyIf(t *testing.T) {
+	metadata := newFakeMetadata("1")
+	metadata.supportsWait = true
+	server := httptest.NewServer(metadata)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Waits answered unchanged after 150ms are not taken for ignored
+	w := New(server.URL+"/2015-12-19", time.Hour, 200*time.Millisecond)
+	w.Resync = 20 * time.Millisecond
+	resync := make(chan bool, 1)
+	resync <- false
+	w.ResyncIf = func() bool {
+		select {
+		case r := <-resync:
+			return r
+		default:
+			return true
+		}
+	}
+
+	versions := make(chan string, 10)
+	go w.Watch(ctx, func(version string) {
+		versions <- version
+	})
+
+	<-versions
+	select {
+	case version := <-versions:
+		t.Fatalf("Expected no resync, got version %q", version)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Resyncs are checked again once the wait ends
+	metadata.setVersion("2")
+	for _, expected := range []string{"2", "2"} {
+		select {
+		case version := <-versions:
+			if version != expected {
+				t.Fatalf("Expected version %s, found %q", expected, version)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected version %s", expected)
+		}
+	}
+}
+
+func TestWatchReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := New(server.URL, time.Millisecond, time.Minute)
+
+	errors := make(chan error, 10)
+	w.OnError = func(err error) {
+		select {
+		case errors <- err:
+		default:
+		}
+	}
+	go w.Watch(ctx, func(string) {
+		t.Errorf("Expected no update without a version")
+	})
+
+	select {
+	case err := <-errors:
+		if _, ok := err.(statusError); !ok {
+			t.Fatalf("Expected a status error, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the error to be reported")
+	}
+}
+
+// fakeClock moves forward by every delay waited for, without sleeping
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.delays = append(f.delays, d)
+	f.now = f.now.Add(d)
+	c := make(chan time.Time, 1)
+	c <- f.now
+	return c
+}
+
+func TestWatchReportsSuccessAfterError(t *testing.T) {
+	requests := 0
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		failing := requests == 2
+		lock.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`"1"`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := New(server.URL, time.Millisecond, time.Minute)
+	w.Retry = backoff.Policy{Initial: time.Millisecond, Max: time.Millisecond, Clock: &fakeClock{}}
+
+	events := make(chan string, 10)
+	report := func(event string) {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	w.OnError = func(error) { report("error") }
+	w.OnSuccess = func() { report("success") }
+	go w.Watch(ctx, func(string) {})
+
+	// The version never changes again, only the reads tell metadata is
+	// back
+	expected := []string{"success", "error", "success"}
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			if event != e {
+				t.Fatalf("Expected %s, found %s", e, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s to be reported", e)
+		}
+	}
+}
+
+func TestWatchGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	clock := &fakeClock{}
+	w := New(server.URL, time.Millisecond, time.Minute)
+	w.Retry = backoff.Policy{Initial: time.Second, Max: 4 * time.Second, MaxWait: 10 * time.Second, Clock: clock}
+
+	failures := 0
+	w.OnError = func(error) { failures++ }
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(context.Background(), func(string) {
+			t.Errorf("Expected no update without a version")
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || failures != 5 {
+			t.Fatalf("Expected to give up after retrying, got %v after %d failures", err, failures)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Watch to give up")
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(clock.delays, expected) {
+		t.Fatalf("Expected delays %v, found %v", expected, clock.delays)
+	}
+}